@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/codec"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/config"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/logging"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const confirmTimeout = 5 * time.Second
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), `Usage: dlq [flags] <command>
+
+Commands:
+  list                             show dead-lettered messages, why they died and their decoded bodies
+  replay <selector>...             republish messages to the exchange and routing key they were first sent to
+  move <queue> <selector>...       move messages, headers and all, to another queue
+  purge                            delete every message in the queue
+
+A selector is a message ID, a position as shown by list, or "all".
+
+Flags:
+`)
+	flag.PrintDefaults()
+}
+
+func main() {
+	queue := flag.String("queue", routing.QueuePerilDLQ, "dead-letter queue to work on")
+	limit := flag.Int("limit", 1000, "most messages to look at")
+	flag.Usage = usage
+	cfg, err := config.Load(flag.CommandLine, os.Args[1:], config.Config{
+		URL:            config.DefaultURL,
+		Heartbeat:      config.DefaultHeartbeat,
+		ConnectionName: "peril-dlq",
+		LogLevel:       "info",
+		LogFormat:      "text",
+		LogFile:        "stderr",
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	logs, err := logging.Setup(cfg.Logging())
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer logs.Close()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	amqpConfig, err := cfg.AMQP()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	conn, err := amqp.DialConfig(cfg.URL, amqpConfig)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer conn.Close()
+	broker := pubsub.NewAMQPBroker(conn)
+
+	switch args[0] {
+	case "list":
+		err = list(broker, *queue, *limit)
+	case "replay":
+		err = transfer(broker, *queue, *limit, args[1:], func(letter pubsub.DeadLetter) (string, string, amqp.Publishing) {
+			return letter.OriginalExchange, letter.OriginalRoutingKey, letter.Replay()
+		})
+	case "move":
+		if len(args) < 2 {
+			usage()
+			os.Exit(2)
+		}
+		target := args[1]
+		err = transfer(broker, *queue, *limit, args[2:], func(letter pubsub.DeadLetter) (string, string, amqp.Publishing) {
+			return "", target, letter.Copy()
+		})
+	case "purge":
+		err = purge(broker, *queue)
+	default:
+		usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// fetch takes up to limit messages without acking them, so they go back when the channel closes.
+func fetch(channel pubsub.Channel, queue string, limit int) ([]pubsub.DeadLetter, error) {
+	var letters []pubsub.DeadLetter
+	for len(letters) < limit {
+		delivery, ok, err := channel.Get(queue, false)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		letters = append(letters, pubsub.NewDeadLetter(delivery))
+	}
+
+	return letters, nil
+}
+
+func list(broker pubsub.Broker, queue string, limit int) error {
+	channel, err := broker.Channel()
+	if err != nil {
+		return err
+	}
+	defer channel.Close()
+
+	letters, err := fetch(channel, queue, limit)
+	if err != nil {
+		return err
+	}
+
+	if len(letters) == 0 {
+		fmt.Printf("%s is empty\n", queue)
+		return nil
+	}
+
+	for i, letter := range letters {
+		printLetter(i+1, letter)
+	}
+
+	return nil
+}
+
+func printLetter(position int, letter pubsub.DeadLetter) {
+	delivery := letter.Delivery
+
+	id := delivery.MessageId
+	if id == "" {
+		id = "-"
+	}
+	fmt.Printf("#%d %s -> %s [%s]\n", position, id, destination(letter.OriginalExchange, letter.OriginalRoutingKey), delivery.ContentType)
+
+	if !delivery.Timestamp.IsZero() || delivery.AppId != "" {
+		fmt.Printf("    published %s by %s\n", delivery.Timestamp.Format(time.RFC3339), delivery.AppId)
+	}
+	if delivery.CorrelationId != "" {
+		fmt.Printf("    correlation %s\n", delivery.CorrelationId)
+	}
+	for _, death := range letter.Deaths {
+		fmt.Printf("    %s in %s x%d, last at %s\n", death.Reason, death.Queue, death.Count, death.Time.Format(time.RFC3339))
+	}
+	if letter.DecodeError != "" {
+		fmt.Printf("    quarantined: %s\n", letter.DecodeError)
+	}
+	fmt.Printf("    %s\n", decode(letter))
+}
+
+func destination(exchange, key string) string {
+	if exchange == "" {
+		exchange = "(default)"
+	}
+
+	return fmt.Sprintf("%s/%s", exchange, key)
+}
+
+// decode renders the body as the game type its routing key carries.
+func decode(letter pubsub.DeadLetter) string {
+	delivery := letter.Delivery
+
+	decoder := codec.JSON
+	if delivery.ContentType != "" {
+		var err error
+		if decoder, err = codec.Lookup(delivery.ContentType); err != nil {
+			return fmt.Sprintf("undecodable (%v): %q", err, delivery.Body)
+		}
+	}
+
+	target := payloadFor(letter.OriginalRoutingKey)
+	if err := decoder.Unmarshal(delivery.Body, target); err != nil {
+		return fmt.Sprintf("undecodable (%v): %q", err, delivery.Body)
+	}
+
+	return fmt.Sprintf("%+v", target)
+}
+
+func payloadFor(routingKey string) any {
+	switch {
+	case gamelogic.ArmyMoves.Matches(routingKey):
+		return &gamelogic.ArmyMove{}
+	case gamelogic.WarRecognitions.Matches(routingKey):
+		return &gamelogic.RecognitionOfWar{}
+	case routing.GameLogs.Matches(routingKey):
+		return &routing.GameLog{}
+	case routing.Pause.Matches(routingKey):
+		return &routing.PlayingState{}
+	default:
+		return new(any)
+	}
+}
+
+// transfer moves the selected messages wherever route says, acking each once it is confirmed.
+func transfer(broker pubsub.Broker, queue string, limit int, selectors []string, route func(pubsub.DeadLetter) (string, string, amqp.Publishing)) error {
+	selected, err := parseSelection(selectors)
+	if err != nil {
+		return err
+	}
+
+	channel, err := broker.Channel()
+	if err != nil {
+		return err
+	}
+	defer channel.Close()
+
+	publishChannel, err := broker.Channel()
+	if err != nil {
+		return err
+	}
+	defer publishChannel.Close()
+
+	publisher, err := pubsub.NewConfirmedPublisher(publishChannel, pubsub.ConfirmOptions{Mandatory: true, Timeout: confirmTimeout})
+	if err != nil {
+		return err
+	}
+
+	letters, err := fetch(channel, queue, limit)
+	if err != nil {
+		return err
+	}
+
+	moved := 0
+	for i, letter := range letters {
+		if !selected.includes(i+1, letter) {
+			continue
+		}
+
+		exchange, key, publishing := route(letter)
+		if err := publisher.PublishWithContext(context.Background(), exchange, key, false, false, publishing); err != nil {
+			log.Printf("Could not publish #%d to %s: %v", i+1, destination(exchange, key), err)
+			continue
+		}
+		if err := letter.Delivery.Ack(false); err != nil {
+			return err
+		}
+
+		fmt.Printf("#%d -> %s\n", i+1, destination(exchange, key))
+		moved++
+	}
+
+	fmt.Printf("%d of %d messages moved\n", moved, len(letters))
+	for _, missing := range selected.unmatched() {
+		fmt.Printf("no message matched %s\n", missing)
+	}
+
+	return nil
+}
+
+func purge(broker pubsub.Broker, queue string) error {
+	channel, err := broker.Channel()
+	if err != nil {
+		return err
+	}
+	defer channel.Close()
+
+	purged, err := channel.QueuePurge(queue, false)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Purged %d messages from %s\n", purged, queue)
+	return nil
+}
+
+type selection struct {
+	all       bool
+	ids       map[string]bool
+	positions map[int]bool
+}
+
+func parseSelection(selectors []string) (*selection, error) {
+	if len(selectors) == 0 {
+		return nil, fmt.Errorf("select messages by ID, by position or with \"all\"")
+	}
+
+	s := &selection{ids: map[string]bool{}, positions: map[int]bool{}}
+	for _, selector := range selectors {
+		if selector == "all" {
+			s.all = true
+		} else if position, err := strconv.Atoi(strings.TrimPrefix(selector, "#")); err == nil {
+			s.positions[position] = false
+		} else {
+			s.ids[selector] = false
+		}
+	}
+
+	return s, nil
+}
+
+func (s *selection) includes(position int, letter pubsub.DeadLetter) bool {
+	if s.all {
+		return true
+	}
+
+	if _, ok := s.positions[position]; ok {
+		s.positions[position] = true
+		return true
+	}
+	if _, ok := s.ids[letter.Delivery.MessageId]; ok {
+		s.ids[letter.Delivery.MessageId] = true
+		return true
+	}
+
+	return false
+}
+
+func (s *selection) unmatched() []string {
+	var missing []string
+	for position, matched := range s.positions {
+		if !matched {
+			missing = append(missing, fmt.Sprintf("#%d", position))
+		}
+	}
+	for id, matched := range s.ids {
+		if !matched {
+			missing = append(missing, id)
+		}
+	}
+
+	return missing
+}
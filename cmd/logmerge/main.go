@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), `Usage: logmerge [flags] [segment]...
+
+Merges the game log segments written by sharded servers into a single time-ordered log. Without
+segments it merges every %s in the current directory.
+
+Flags:
+`, gamelogic.LogSegmentPattern)
+	flag.PrintDefaults()
+}
+
+func main() {
+	output := flag.String("o", "", "file to write the merged log to instead of stdout")
+	flag.Usage = usage
+	flag.Parse()
+
+	segments := flag.Args()
+	if len(segments) == 0 {
+		var err error
+		if segments, err = filepath.Glob(gamelogic.LogSegmentPattern); err != nil {
+			log.Fatalln(err)
+		}
+		if len(segments) == 0 {
+			log.Fatalf("no %s segments found", gamelogic.LogSegmentPattern)
+		}
+	}
+
+	var w io.WriteCloser = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		w = f
+	}
+
+	if err := gamelogic.MergeLogs(w, segments...); err != nil {
+		log.Fatalln(err)
+	}
+	if err := w.Close(); err != nil {
+		log.Fatalln(err)
+	}
+}
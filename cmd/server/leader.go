@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// duty starts one of the jobs only the leading server runs. Its scheduled jobs must stop when ctx
+// is cancelled, and it must not leave any running when it fails.
+type duty func(ctx context.Context) ([]*pubsub.Subscription, error)
+
+// newLeaderDuties answers the lobby, shows moderation reports, watches the queues and, unless logs
+// are sharded, writes the shared game log, which is why only the leader may read its queue.
+func newLeaderDuties(broker pubsub.Broker, lobby *lobby, ingest logIngest, throttle pubsub.SubscribeOption) *duties {
+	jobs := []duty{
+		func(ctx context.Context) ([]*pubsub.Subscription, error) {
+			// A server that takes over starts with an empty, unpaused lobby; players reappear as they join.
+			lobby.reset()
+			return serveLobby(ctx, broker, lobby)
+		},
+		func(ctx context.Context) ([]*pubsub.Subscription, error) {
+			return subscribed(pubsub.Bind(routing.Moderation).Subscribe(ctx, broker, nil, handlerModeration))
+		},
+		func(ctx context.Context) ([]*pubsub.Subscription, error) {
+			go watchQueues(ctx, newQueueStats(broker, ingest.queues()), queueCheckInterval)
+			return nil, nil
+		},
+	}
+	if !ingest.sharded() {
+		jobs = append(jobs, func(ctx context.Context) ([]*pubsub.Subscription, error) {
+			return subscribed(subscribeLogs(ctx, broker, ingest, throttle))
+		})
+	}
+
+	return &duties{duties: jobs, backoff: dutiesBackoff}
+}
+
+func subscribed(subscription *pubsub.Subscription, err error) ([]*pubsub.Subscription, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	return []*pubsub.Subscription{subscription}, nil
+}
+
+// duties runs the leader's duties while this server leads. Each starts on its own, and one that
+// fails has the subscriptions it returned closed and is tried again, without holding up the rest.
+type duties struct {
+	duties  []duty
+	backoff pubsub.Backoff
+
+	mu            sync.Mutex
+	cancel        context.CancelFunc
+	running       *sync.WaitGroup
+	subscriptions []*pubsub.Subscription
+}
+
+// onChange is the election callback.
+func (d *duties) onChange(leader bool) {
+	if leader {
+		fmt.Println("This server is now the leader")
+		d.begin()
+	} else {
+		fmt.Println("This server is no longer the leader")
+		d.stop()
+	}
+	fmt.Print("> ")
+}
+
+// begin takes up the duties in the background, so the election keeps running while they retry.
+func (d *duties) begin() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	running := &sync.WaitGroup{}
+	d.cancel, d.running = cancel, running
+	for _, start := range d.duties {
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			d.takeUp(ctx, start)
+		}()
+	}
+}
+
+// takeUp starts a duty, retrying until it starts or ctx is cancelled.
+func (d *duties) takeUp(ctx context.Context, start duty) {
+	for attempt := 0; ; attempt++ {
+		subscriptions, err := start(ctx)
+		if err == nil {
+			d.mu.Lock()
+			d.subscriptions = append(d.subscriptions, subscriptions...)
+			d.mu.Unlock()
+			return
+		}
+		closeSubscriptions(subscriptions)
+		if ctx.Err() != nil {
+			return
+		}
+
+		delay := d.backoff.Delay(attempt)
+		slog.Error("Could not take up leader duty", "attempt", attempt+1, "retry_in", delay, "error", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// stop returns once every duty has stopped, including any still starting.
+func (d *duties) stop() {
+	d.mu.Lock()
+	cancel, running := d.cancel, d.running
+	d.cancel, d.running = nil, nil
+	d.mu.Unlock()
+
+	if cancel == nil {
+		return
+	}
+	cancel()
+	running.Wait()
+
+	d.mu.Lock()
+	subscriptions := d.subscriptions
+	d.subscriptions = nil
+	d.mu.Unlock()
+	closeSubscriptions(subscriptions)
+}
+
+// watchQueues logs the stats command's warnings every interval.
+func watchQueues(ctx context.Context, stats *queueStats, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_, warnings, err := stats.sample()
+			if err != nil {
+				slog.Warn("Could not inspect queues", "error", err)
+				continue
+			}
+			for _, warning := range warnings {
+				slog.Warn("Queue health", "warning", warning)
+			}
+		}
+	}
+}
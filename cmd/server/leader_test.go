@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testTimeout = 2 * time.Second
+
+var testBackoff = pubsub.Backoff{Initial: time.Millisecond, Max: 10 * time.Millisecond}
+
+func newTestBroker(t *testing.T) *pubsub.MemoryBroker {
+	t.Helper()
+
+	broker := pubsub.NewMemoryBroker()
+	if err := pubsub.ApplyTopology(broker, routing.PerilTopology); err != nil {
+		t.Fatal(err)
+	}
+
+	return broker
+}
+
+// closed reports whether a subscription has stopped within the test timeout.
+func closed(subscription *pubsub.Subscription) bool {
+	select {
+	case <-subscription.Done():
+		return true
+	case <-time.After(testTimeout):
+		return false
+	}
+}
+
+// flakyStart is a duty that subscribes once per attempt and then fails, for the first
+// failures attempts or, when that is negative, every one.
+type flakyStart struct {
+	broker   pubsub.Broker
+	failures int
+
+	mu       sync.Mutex
+	attempts [][]*pubsub.Subscription
+	started  chan int
+}
+
+func (f *flakyStart) start(ctx context.Context) ([]*pubsub.Subscription, error) {
+	f.mu.Lock()
+	attempt := len(f.attempts)
+	f.mu.Unlock()
+
+	queue := fmt.Sprintf("test_duties_%d", attempt)
+	subscription, err := pubsub.SubscribeMessage(ctx, f.broker, routing.ExchangePerilTopic, queue, queue+".*", pubsub.QueueTypeTransient, func(pubsub.Message[string]) pubsub.AckType {
+		return pubsub.Ack
+	})
+	if err != nil {
+		return nil, err
+	}
+	subscriptions := []*pubsub.Subscription{subscription}
+
+	f.mu.Lock()
+	f.attempts = append(f.attempts, subscriptions)
+	f.mu.Unlock()
+	f.started <- attempt
+
+	if f.failures < 0 || attempt < f.failures {
+		return subscriptions, errors.New("the broker said no")
+	}
+	return subscriptions, nil
+}
+
+func TestDutiesRetry(t *testing.T) {
+	flaky := &flakyStart{broker: newTestBroker(t), failures: 2, started: make(chan int, 10)}
+	d := &duties{duties: []duty{flaky.start}, backoff: testBackoff}
+
+	d.begin()
+	for want := range 3 {
+		select {
+		case attempt := <-flaky.started:
+			if attempt != want {
+				t.Fatalf("attempt %d, want %d", attempt, want)
+			}
+		case <-time.After(testTimeout):
+			t.Fatalf("attempt %d never came", want)
+		}
+	}
+
+	// What a failed attempt had started is closed rather than left half running.
+	for _, subscription := range append(flaky.attempts[0], flaky.attempts[1]...) {
+		if !closed(subscription) {
+			t.Error("a failed attempt's subscription is still open")
+		}
+	}
+	select {
+	case <-flaky.attempts[2][0].Done():
+		t.Error("the successful attempt's subscription was closed")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	d.stop()
+	if !closed(flaky.attempts[2][0]) {
+		t.Error("stop left the duties' subscription open")
+	}
+}
+
+func TestDutiesStopWhileRetrying(t *testing.T) {
+	flaky := &flakyStart{broker: newTestBroker(t), failures: -1, started: make(chan int, 100)}
+	d := &duties{duties: []duty{flaky.start}, backoff: testBackoff}
+
+	d.begin()
+	<-flaky.started
+	d.stop()
+
+	// Once stop returns, no attempt is running or still to come.
+	for len(flaky.started) > 0 {
+		<-flaky.started
+	}
+	time.Sleep(5 * testBackoff.Max)
+	if len(flaky.started) != 0 {
+		t.Error("duties kept retrying after stop")
+	}
+	for _, subscriptions := range flaky.attempts {
+		if !closed(subscriptions[0]) {
+			t.Error("a failed attempt's subscription is still open")
+		}
+	}
+
+	// Stopping again, or without having begun, does nothing.
+	d.stop()
+	(&duties{}).stop()
+}
+
+// TestDutiesIndependent checks that a duty that keeps failing doesn't keep the others from running.
+func TestDutiesIndependent(t *testing.T) {
+	broker := newTestBroker(t)
+	failing := &flakyStart{broker: broker, failures: -1, started: make(chan int, 100)}
+	working := &flakyStart{broker: broker, started: make(chan int, 1)}
+	d := &duties{duties: []duty{failing.start, working.start}, backoff: testBackoff}
+
+	d.begin()
+	defer d.stop()
+	<-working.started
+	for range 3 {
+		<-failing.started
+	}
+
+	select {
+	case <-working.attempts[0][0].Done():
+		t.Error("the working duty was stopped while the other retried")
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+// queueConsumers counts a queue's consumers, or returns -1 when the queue doesn't exist yet.
+func queueConsumers(t *testing.T, broker pubsub.Broker, name string) int {
+	t.Helper()
+
+	channel, err := broker.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer channel.Close()
+
+	queue, err := channel.QueueDeclarePassive(name, false, false, false, false, nil)
+	if err != nil {
+		return -1
+	}
+
+	return queue.Consumers
+}
+
+func eventually(t *testing.T, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(testTimeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// TestLeaderDuties takes up a leader's duties on a broker set up as the server sets it up, and
+// floods the game log to check the sender is throttled and reported.
+func TestLeaderDuties(t *testing.T) {
+	broker := newTestBroker(t)
+	channel, err := broker.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer channel.Close()
+
+	// Moderation reports go to the leader, and to this queue for the test to read.
+	if _, _, err := pubsub.DeclareAndBind(broker, routing.ExchangePerilTopic, "test_moderation", routing.Moderation.Pattern, pubsub.QueueTypeDurable); err != nil {
+		t.Fatal(err)
+	}
+
+	ingest, err := newLogIngest("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ingest.file = filepath.Join(t.TempDir(), "game.log")
+	throttle := pubsub.WithThrottle(pubsub.NewKeyedLimiter(0.001, 1), logSender, newModerator(channel, time.Minute).limited)
+	d := newLeaderDuties(broker, newLobby(), ingest, throttle)
+	d.backoff = testBackoff
+	d.begin()
+	defer d.stop()
+
+	for _, queue := range []string{routing.RPCJoinKey, routing.Moderation.Queue, routing.GameLogs.Queue} {
+		eventually(t, func() bool { return queueConsumers(t, broker, queue) == 1 })
+	}
+
+	for i := range 5 {
+		err := pubsub.Bind(routing.GameLogs).Publish(context.Background(), channel, []string{"spammer"}, routing.GameLog{
+			CurrentTime: time.Now(),
+			Message:     fmt.Sprintf("log %d", i),
+			Username:    "spammer",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The report comes as the flood arrives, not once the first log has taken its second to write.
+	var report routing.ModerationEvent
+	eventually(t, func() bool {
+		delivery, ok, err := channel.Get("test_moderation", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			if err := json.Unmarshal(delivery.Body, &report); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return ok
+	})
+	if report.Username != "spammer" || report.Dropped != 1 {
+		t.Errorf("got report %+v, want spammer reported for their first dropped log", report)
+	}
+
+	// The log within the limit is written; the rest are dead-lettered.
+	eventually(t, func() bool {
+		data, _ := os.ReadFile(ingest.file)
+		return strings.Contains(string(data), "spammer: log 0")
+	})
+	channel.Close()
+	eventually(t, func() bool {
+		queue, err := broker.Channel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer queue.Close()
+		dlq, err := queue.QueueDeclarePassive(routing.QueuePerilDLQ, false, false, false, false, nil)
+		return err == nil && dlq.Messages == 4
+	})
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	"log/slog"
+	"sort"
+	"sync"
+)
+
+// lobby is what the server knows about the game: whether it is paused and who has joined.
+type lobby struct {
+	mu      sync.Mutex
+	paused  bool
+	players map[string]struct{}
+}
+
+func newLobby() *lobby {
+	return &lobby{players: map[string]struct{}{}}
+}
+
+// reset forgets everything, for a server that has just taken over from another.
+func (l *lobby) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.paused = false
+	l.players = map[string]struct{}{}
+}
+
+func (l *lobby) setPaused(paused bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.paused = paused
+}
+
+func (l *lobby) snapshot() routing.Lobby {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	players := make([]string, 0, len(l.players))
+	for player := range l.players {
+		players = append(players, player)
+	}
+	sort.Strings(players)
+
+	return routing.Lobby{PlayingState: routing.PlayingState{IsPaused: l.paused}, Players: players}
+}
+
+func (l *lobby) join(request pubsub.Message[routing.PlayerPresence]) (routing.Lobby, error) {
+	if request.Body.Username == "" {
+		return routing.Lobby{}, errors.New("username is required")
+	}
+
+	l.mu.Lock()
+	l.players[request.Body.Username] = struct{}{}
+	l.mu.Unlock()
+
+	slog.InfoContext(request.Context(), "Player joined the game", "player", request.Body.Username)
+	return l.snapshot(), nil
+}
+
+func (l *lobby) leave(request pubsub.Message[routing.PlayerPresence]) (routing.Lobby, error) {
+	l.mu.Lock()
+	delete(l.players, request.Body.Username)
+	l.mu.Unlock()
+
+	slog.InfoContext(request.Context(), "Player left the game", "player", request.Body.Username)
+	return l.snapshot(), nil
+}
+
+func (l *lobby) listPlayers(pubsub.Message[struct{}]) (routing.Lobby, error) {
+	return l.snapshot(), nil
+}
+
+func (l *lobby) pauseState(pubsub.Message[struct{}]) (routing.PlayingState, error) {
+	return l.snapshot().PlayingState, nil
+}
+
+// serveLobby exposes the lobby to clients as request/reply endpoints on the direct exchange.
+func serveLobby(ctx context.Context, broker pubsub.Broker, l *lobby) ([]*pubsub.Subscription, error) {
+	var subscriptions []*pubsub.Subscription
+	serve := func(subscription *pubsub.Subscription, err error) error {
+		if err == nil {
+			subscriptions = append(subscriptions, subscription)
+		}
+		return err
+	}
+
+	err := errors.Join(
+		serve(pubsub.Serve(ctx, broker, routing.ExchangePerilDirect, routing.RPCJoinKey, routing.RPCJoinKey, pubsub.QueueTypeTransient, l.join)),
+		serve(pubsub.Serve(ctx, broker, routing.ExchangePerilDirect, routing.RPCLeaveKey, routing.RPCLeaveKey, pubsub.QueueTypeTransient, l.leave)),
+		serve(pubsub.Serve(ctx, broker, routing.ExchangePerilDirect, routing.RPCPlayersKey, routing.RPCPlayersKey, pubsub.QueueTypeTransient, l.listPlayers)),
+		serve(pubsub.Serve(ctx, broker, routing.ExchangePerilDirect, routing.RPCPauseStateKey, routing.RPCPauseStateKey, pubsub.QueueTypeTransient, l.pauseState)),
+	)
+
+	return subscriptions, err
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// moderator reports players whose game logs are being throttled, at most once per interval each.
+type moderator struct {
+	publisher pubsub.Publisher
+	interval  time.Duration
+
+	mu        sync.Mutex
+	dropped   map[string]int
+	reported  map[string]time.Time
+	lastSweep time.Time
+}
+
+func newModerator(publisher pubsub.Publisher, interval time.Duration) *moderator {
+	return &moderator{
+		publisher: publisher,
+		interval:  interval,
+		dropped:   map[string]int{},
+		reported:  map[string]time.Time{},
+		lastSweep: time.Now(),
+	}
+}
+
+// limited is the Throttle callback for a dropped game log.
+func (m *moderator) limited(ctx context.Context, username string) {
+	now := time.Now()
+
+	m.mu.Lock()
+	if now.Sub(m.lastSweep) > m.interval {
+		for player, at := range m.reported {
+			if now.Sub(at) >= m.interval {
+				delete(m.reported, player)
+				delete(m.dropped, player)
+			}
+		}
+		m.lastSweep = now
+	}
+	m.dropped[username]++
+	if now.Sub(m.reported[username]) < m.interval {
+		m.mu.Unlock()
+		return
+	}
+	dropped := m.dropped[username]
+	delete(m.dropped, username)
+	m.reported[username] = now
+	m.mu.Unlock()
+
+	err := pubsub.Bind(routing.Moderation).Publish(ctx, m.publisher, []string{username}, routing.ModerationEvent{
+		Username: username,
+		Reason:   "game log rate limit exceeded",
+		Dropped:  dropped,
+		Time:     now,
+	}, pubsub.WithMandatory())
+	if err != nil {
+		slog.ErrorContext(ctx, "Could not publish moderation event", "player", username, "error", err)
+		return
+	}
+	slog.WarnContext(ctx, "Reported player for flooding game logs", "player", username, "dropped", dropped)
+}
+
+// handlerModeration shows the leader's operator the reports every server makes.
+func handlerModeration(event routing.ModerationEvent) pubsub.AckType {
+	fmt.Printf("Reported %s at %s for %s, %d dropped\n", event.Username, event.Time.Format(time.TimeOnly), event.Reason, event.Dropped)
+	return pubsub.Ack
+}
+
+// logSender is the player a game log delivery is from, as named by its routing key.
+func logSender(delivery amqp.Delivery) string {
+	params, err := routing.GameLogs.Params(delivery.RoutingKey)
+	if err != nil {
+		return ""
+	}
+
+	return params[0]
+}
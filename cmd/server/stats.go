@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	"os"
+	"text/tabwriter"
+)
+
+// queueThresholds are the points past which stats warns about a queue. Zero turns a check off.
+type queueThresholds struct {
+	depth int
+	// growth is in messages per second.
+	growth float64
+	// consumers is the fewest consumers the queue should have while it holds messages.
+	consumers int
+}
+
+var defaultThresholds = queueThresholds{depth: 1000, growth: 10, consumers: 1}
+
+var thresholds = map[string]queueThresholds{
+	// Nothing consumes the dead-letter queue; anything in it needs a look with cmd/dlq.
+	routing.QueuePerilDLQ: {depth: 1},
+}
+
+// queueStats remembers the last sample of each queue to work out growth.
+type queueStats struct {
+	broker   pubsub.Broker
+	queues   []string
+	previous map[string]pubsub.QueueStats
+}
+
+func newQueueStats(broker pubsub.Broker, queues []string) *queueStats {
+	return &queueStats{broker: broker, queues: queues, previous: map[string]pubsub.QueueStats{}}
+}
+
+// queueRow is one queue's line in the stats table.
+type queueRow struct {
+	pubsub.QueueStats
+	// growth is the formatted growth rate, or "-" without an earlier sample to compare with.
+	growth string
+}
+
+// sample returns every queue's stats and a warning for each threshold crossed.
+func (q *queueStats) sample() ([]queueRow, []string, error) {
+	stats, err := pubsub.Inspect(q.broker, q.queues...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var rows []queueRow
+	var warnings []string
+	for _, s := range stats {
+		row := queueRow{QueueStats: s, growth: "-"}
+		rows = append(rows, row)
+		if s.Missing {
+			warnings = append(warnings, fmt.Sprintf("%s does not exist", s.Name))
+			continue
+		}
+
+		limits := thresholdsFor(s.Name)
+		previous, ok := q.previous[s.Name]
+		if ok && !previous.Missing {
+			rate := s.GrowthRate(previous)
+			rows[len(rows)-1].growth = fmt.Sprintf("%+.1f/s", rate)
+			if limits.growth > 0 && rate > limits.growth {
+				warnings = append(warnings, fmt.Sprintf("%s is growing by %.1f messages/s, more than %.1f/s", s.Name, rate, limits.growth))
+			}
+		}
+		q.previous[s.Name] = s
+
+		if limits.depth > 0 && s.Messages >= limits.depth {
+			warnings = append(warnings, fmt.Sprintf("%s holds %d messages, at least %d", s.Name, s.Messages, limits.depth))
+		}
+		if s.Messages > 0 && s.Consumers < limits.consumers {
+			warnings = append(warnings, fmt.Sprintf("%s has messages but %d consumers", s.Name, s.Consumers))
+		}
+	}
+
+	return rows, warnings, nil
+}
+
+func (q *queueStats) print() error {
+	rows, warnings, err := q.sample()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "QUEUE\tMESSAGES\tCONSUMERS\tGROWTH")
+	for _, row := range rows {
+		if row.Missing {
+			fmt.Fprintf(w, "%s\t-\t-\t-\n", row.Name)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\n", row.Name, row.Messages, row.Consumers, row.growth)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	for _, warning := range warnings {
+		fmt.Printf("WARNING: %s\n", warning)
+	}
+
+	return nil
+}
+
+func thresholdsFor(queue string) queueThresholds {
+	if t, ok := thresholds[queue]; ok {
+		return t
+	}
+
+	return defaultThresholds
+}
@@ -0,0 +1,390 @@
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	cborUnsigned byte = iota
+	cborNegative
+	cborBytes
+	cborText
+	cborArray
+	cborMap
+	cborTag
+	cborSimple
+)
+
+const (
+	cborTagDateTime = 0
+	cborTagEpoch    = 1
+	cborIndefinite  = 31
+	cborBreak       = 0xff
+)
+
+type cborCodec struct{}
+
+func (cborCodec) ContentType() string {
+	return ContentTypeCBOR
+}
+
+func (cborCodec) Marshal(v any) ([]byte, error) {
+	tree, err := toValue(reflect.ValueOf(v), 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var e cborEncoder
+	e.encode(tree)
+	return e.buf, nil
+}
+
+func (cborCodec) Unmarshal(data []byte, v any) error {
+	target := reflect.ValueOf(v)
+	if target.Kind() != reflect.Pointer || target.IsNil() {
+		return fmt.Errorf("cbor: cannot unmarshal into %T", v)
+	}
+
+	d := cborDecoder{data: data}
+	tree, err := d.decode(0)
+	if err != nil {
+		return fmt.Errorf("cbor: %w", err)
+	}
+	if d.pos != len(d.data) {
+		return fmt.Errorf("cbor: %d trailing bytes", len(d.data)-d.pos)
+	}
+
+	return fromValue(tree, target.Elem(), 0)
+}
+
+type cborEncoder struct {
+	buf []byte
+}
+
+func (e *cborEncoder) head(major byte, n uint64) {
+	switch {
+	case n < 24:
+		e.buf = append(e.buf, major<<5|byte(n))
+	case n <= math.MaxUint8:
+		e.buf = append(e.buf, major<<5|24, byte(n))
+	case n <= math.MaxUint16:
+		e.buf = binary.BigEndian.AppendUint16(append(e.buf, major<<5|25), uint16(n))
+	case n <= math.MaxUint32:
+		e.buf = binary.BigEndian.AppendUint32(append(e.buf, major<<5|26), uint32(n))
+	default:
+		e.buf = binary.BigEndian.AppendUint64(append(e.buf, major<<5|27), n)
+	}
+}
+
+func (e *cborEncoder) encode(tree any) {
+	switch v := tree.(type) {
+	case nil:
+		e.buf = append(e.buf, 0xf6)
+	case bool:
+		if v {
+			e.buf = append(e.buf, 0xf5)
+		} else {
+			e.buf = append(e.buf, 0xf4)
+		}
+	case int64:
+		if v >= 0 {
+			e.head(cborUnsigned, uint64(v))
+		} else {
+			e.head(cborNegative, uint64(^v))
+		}
+	case uint64:
+		e.head(cborUnsigned, v)
+	case float64:
+		e.buf = binary.BigEndian.AppendUint64(append(e.buf, 0xfb), math.Float64bits(v))
+	case string:
+		e.head(cborText, uint64(len(v)))
+		e.buf = append(e.buf, v...)
+	case []byte:
+		e.head(cborBytes, uint64(len(v)))
+		e.buf = append(e.buf, v...)
+	case []any:
+		e.head(cborArray, uint64(len(v)))
+		for _, item := range v {
+			e.encode(item)
+		}
+	case mapValue:
+		e.head(cborMap, uint64(len(v)))
+		for _, entry := range v {
+			e.encode(entry.key)
+			e.encode(entry.value)
+		}
+	case time.Time:
+		// RFC 3339 only has four-digit years.
+		if year := v.Year(); year < 0 || year > 9999 {
+			e.head(cborTag, cborTagEpoch)
+			if v.Nanosecond() == 0 {
+				e.encode(v.Unix())
+			} else {
+				e.encode(float64(v.Unix()) + float64(v.Nanosecond())/1e9)
+			}
+			return
+		}
+		e.head(cborTag, cborTagDateTime)
+		e.encode(v.Format(time.RFC3339Nano))
+	}
+}
+
+type cborDecoder struct {
+	data []byte
+	pos  int
+}
+
+var errBreak = errors.New("unexpected break")
+
+func (d *cborDecoder) next(n uint64) ([]byte, error) {
+	if n > uint64(len(d.data)-d.pos) {
+		return nil, errTruncated
+	}
+
+	b := d.data[d.pos : d.pos+int(n)]
+	d.pos += int(n)
+	return b, nil
+}
+
+func (d *cborDecoder) argument(info byte) (uint64, error) {
+	if info < 24 {
+		return uint64(info), nil
+	}
+	if info > 27 {
+		return 0, fmt.Errorf("invalid additional information %d", info)
+	}
+
+	b, err := d.next(1 << (info - 24))
+	if err != nil {
+		return 0, err
+	}
+
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+func (d *cborDecoder) decode(depth int) (any, error) {
+	if depth > maxDepth {
+		return nil, errTooDeep
+	}
+
+	b, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	major, info := b[0]>>5, b[0]&0x1f
+
+	if major == cborSimple {
+		return d.decodeSimple(info)
+	}
+
+	if info == cborIndefinite {
+		return d.decodeIndefinite(major, depth)
+	}
+
+	n, err := d.argument(info)
+	if err != nil {
+		return nil, err
+	}
+
+	switch major {
+	case cborUnsigned:
+		return n, nil
+	case cborNegative:
+		if n > math.MaxInt64 {
+			return nil, fmt.Errorf("negative integer -1-%d overflows int64", n)
+		}
+		return -1 - int64(n), nil
+	case cborBytes:
+		data, err := d.next(n)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte(nil), data...), nil
+	case cborText:
+		data, err := d.next(n)
+		if err != nil {
+			return nil, err
+		}
+		if !utf8.Valid(data) {
+			return nil, errors.New("text string is not valid UTF-8")
+		}
+		return string(data), nil
+	case cborArray:
+		if n > uint64(len(d.data)-d.pos) {
+			return nil, errTruncated
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = d.decode(depth + 1); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	case cborMap:
+		if n > uint64(len(d.data)-d.pos)/2 {
+			return nil, errTruncated
+		}
+		entries := make(mapValue, n)
+		for i := range entries {
+			if entries[i], err = d.decodeEntry(depth); err != nil {
+				return nil, err
+			}
+		}
+		return entries, nil
+	default:
+		return d.decodeTag(n, depth)
+	}
+}
+
+func (d *cborDecoder) decodeEntry(depth int) (mapEntry, error) {
+	key, err := d.decode(depth + 1)
+	if err != nil {
+		return mapEntry{}, err
+	}
+
+	value, err := d.decode(depth + 1)
+	if err != nil {
+		return mapEntry{}, err
+	}
+
+	return mapEntry{key: key, value: value}, nil
+}
+
+func (d *cborDecoder) decodeSimple(info byte) (any, error) {
+	switch info {
+	case 20:
+		return false, nil
+	case 21:
+		return true, nil
+	case 22, 23:
+		return nil, nil
+	case 25:
+		bits, err := d.argument(info)
+		return halfToFloat(uint16(bits)), err
+	case 26:
+		bits, err := d.argument(info)
+		return float64(math.Float32frombits(uint32(bits))), err
+	case 27:
+		bits, err := d.argument(info)
+		return math.Float64frombits(bits), err
+	case cborIndefinite:
+		return nil, errBreak
+	default:
+		return nil, fmt.Errorf("unsupported simple value %d", info)
+	}
+}
+
+func (d *cborDecoder) decodeTag(tag uint64, depth int) (any, error) {
+	content, err := d.decode(depth + 1)
+	if err != nil {
+		return nil, err
+	}
+
+	switch tag {
+	case cborTagDateTime:
+		text, ok := content.(string)
+		if !ok {
+			return nil, fmt.Errorf("date/time tag on %T", content)
+		}
+		return time.Parse(time.RFC3339Nano, text)
+	case cborTagEpoch:
+		return asTime(content)
+	default:
+		return content, nil
+	}
+}
+
+// decodeIndefinite reads an indefinite-length string, array or map up to its break marker.
+func (d *cborDecoder) decodeIndefinite(major byte, depth int) (any, error) {
+	var (
+		chunks  []byte
+		items   []any
+		entries mapValue
+	)
+
+	for {
+		if d.pos < len(d.data) && d.data[d.pos] == cborBreak {
+			d.pos++
+			break
+		}
+
+		switch major {
+		case cborBytes, cborText:
+			chunk, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			switch c := chunk.(type) {
+			case []byte:
+				if major != cborBytes {
+					return nil, errors.New("byte string chunk inside text string")
+				}
+				chunks = append(chunks, c...)
+			case string:
+				if major != cborText {
+					return nil, errors.New("text string chunk inside byte string")
+				}
+				chunks = append(chunks, c...)
+			default:
+				return nil, fmt.Errorf("invalid chunk %T in indefinite-length string", chunk)
+			}
+		case cborArray:
+			item, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		case cborMap:
+			entry, err := d.decodeEntry(depth)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		default:
+			return nil, fmt.Errorf("major type %d cannot have indefinite length", major)
+		}
+	}
+
+	switch major {
+	case cborBytes:
+		return append([]byte{}, chunks...), nil
+	case cborText:
+		return string(chunks), nil
+	case cborArray:
+		return append([]any{}, items...), nil
+	default:
+		return append(mapValue{}, entries...), nil
+	}
+}
+
+func halfToFloat(bits uint16) float64 {
+	sign := 1.0
+	if bits&0x8000 != 0 {
+		sign = -1
+	}
+
+	exponent := int(bits >> 10 & 0x1f)
+	mantissa := float64(bits & 0x3ff)
+
+	switch exponent {
+	case 0:
+		return sign * math.Ldexp(mantissa, -24)
+	case 0x1f:
+		if mantissa == 0 {
+			return math.Inf(int(sign))
+		}
+		return math.NaN()
+	default:
+		return sign * math.Ldexp(mantissa+1024, exponent-25)
+	}
+}
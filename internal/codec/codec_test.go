@@ -0,0 +1,173 @@
+package codec
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testArmy struct {
+	Units    []string
+	Strength int
+}
+
+type testMessage struct {
+	Name     string
+	Count    int
+	Big      uint64
+	Negative int8
+	Ratio    float64
+	Small    float32
+	OK       bool
+	At       time.Time
+	Data     []byte
+	Tags     []string
+	Scores   map[string]int
+	Army     testArmy
+	Reserve  *testArmy
+	Missing  *testArmy
+	Anything any
+}
+
+var testCodecs = []Codec{JSON, Gob, MsgPack, CBOR}
+
+func TestRoundTrip(t *testing.T) {
+	want := testMessage{
+		Name:     "washington",
+		Count:    -42,
+		Big:      1<<64 - 1,
+		Negative: -128,
+		Ratio:    0.1,
+		Small:    1.5,
+		OK:       true,
+		At:       time.Date(2024, 7, 4, 12, 30, 15, 123456789, time.UTC),
+		Data:     []byte{0, 1, 2, 255},
+		Tags:     []string{"infantry", "", "artillery"},
+		Scores:   map[string]int{"europe": 3, "asia": -1},
+		Army:     testArmy{Units: []string{"cavalry"}, Strength: 7},
+		Reserve:  &testArmy{Strength: 1},
+		Anything: "any",
+	}
+
+	for _, c := range testCodecs {
+		t.Run(c.ContentType(), func(t *testing.T) {
+			data, err := c.Marshal(want)
+			if err != nil {
+				t.Fatalf("Marshal: %v", err)
+			}
+
+			var got testMessage
+			if err := c.Unmarshal(data, &got); err != nil {
+				t.Fatalf("Unmarshal: %v", err)
+			}
+			if !got.At.Equal(want.At) {
+				t.Errorf("At = %v, want %v", got.At, want.At)
+			}
+			got.At = want.At
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("round trip:\n got %+v\nwant %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestDecodeIntoAny(t *testing.T) {
+	for _, c := range []Codec{MsgPack, CBOR} {
+		t.Run(c.ContentType(), func(t *testing.T) {
+			data, err := c.Marshal(map[string]any{"n": 1, "list": []any{"a", true, nil}, "nested": map[string]any{"x": 1.5}})
+			if err != nil {
+				t.Fatalf("Marshal: %v", err)
+			}
+
+			var got any
+			if err := c.Unmarshal(data, &got); err != nil {
+				t.Fatalf("Unmarshal: %v", err)
+			}
+			want := map[string]any{"n": int64(1), "list": []any{"a", true, nil}, "nested": map[string]any{"x": 1.5}}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %#v, want %#v", got, want)
+			}
+		})
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		codec Codec
+		data  []byte
+	}{
+		{"msgpack truncated", MsgPack, []byte{0x92, 0x01}},
+		{"msgpack trailing bytes", MsgPack, []byte{0x01, 0x02}},
+		{"msgpack type mismatch", MsgPack, []byte{0xa1, 'x'}},
+		{"cbor truncated", CBOR, []byte{0x82, 0x01}},
+		{"cbor trailing bytes", CBOR, []byte{0x01, 0x02}},
+		{"cbor type mismatch", CBOR, []byte{0x61, 'x'}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got struct{ Count int }
+			if err := tt.codec.Unmarshal(tt.data, &got.Count); err == nil {
+				t.Errorf("Unmarshal(%x) succeeded with %+v", tt.data, got)
+			}
+		})
+	}
+}
+
+func TestLookup(t *testing.T) {
+	for _, c := range testCodecs {
+		got, err := Lookup(c.ContentType() + "; charset=utf-8")
+		if err != nil || got != c {
+			t.Errorf("Lookup(%q) = %v, %v", c.ContentType(), got, err)
+		}
+	}
+
+	if _, err := Lookup("text/plain"); err == nil {
+		t.Error("Lookup(text/plain) succeeded")
+	}
+}
+
+// fuzzDecode decodes untrusted bytes the way the dlq tool does, then checks that whatever decoded
+// can be encoded and decoded again.
+func fuzzDecode(t *testing.T, c Codec, data []byte) {
+	var v any
+	if err := c.Unmarshal(data, &v); err != nil {
+		return
+	}
+
+	encoded, err := c.Marshal(v)
+	if err != nil {
+		t.Fatalf("Marshal(%#v): %v", v, err)
+	}
+	var again any
+	if err := c.Unmarshal(encoded, &again); err != nil {
+		t.Fatalf("Unmarshal(%x) of re-encoded value: %v", encoded, err)
+	}
+
+	var message testMessage
+	_ = c.Unmarshal(data, &message)
+}
+
+func FuzzMsgPack(f *testing.F) {
+	seed, _ := MsgPack.Marshal(testMessage{Name: "seed", Tags: []string{"a"}, Scores: map[string]int{"b": 1}})
+	f.Add(seed)
+	f.Add([]byte("\x820\xa10\xc00"))
+	f.Add(bytes.Repeat([]byte{0x91}, 300))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzDecode(t, MsgPack, data)
+	})
+}
+
+func FuzzCBOR(f *testing.F) {
+	seed, _ := CBOR.Marshal(testMessage{Name: "seed", Tags: []string{"a"}, Scores: map[string]int{"b": 1}})
+	f.Add(seed)
+	f.Add([]byte("\xa500\xf70000000"))
+	f.Add(bytes.Repeat([]byte{0x81}, 300))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzDecode(t, CBOR, data)
+	})
+}
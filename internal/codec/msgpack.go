@@ -0,0 +1,348 @@
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+)
+
+const msgPackTimestampExt = -1
+
+type msgPackCodec struct{}
+
+func (msgPackCodec) ContentType() string {
+	return ContentTypeMsgPack
+}
+
+func (msgPackCodec) Marshal(v any) ([]byte, error) {
+	tree, err := toValue(reflect.ValueOf(v), 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var e msgPackEncoder
+	e.encode(tree)
+	return e.buf, nil
+}
+
+func (msgPackCodec) Unmarshal(data []byte, v any) error {
+	target := reflect.ValueOf(v)
+	if target.Kind() != reflect.Pointer || target.IsNil() {
+		return fmt.Errorf("msgpack: cannot unmarshal into %T", v)
+	}
+
+	d := msgPackDecoder{data: data}
+	tree, err := d.decode(0)
+	if err != nil {
+		return fmt.Errorf("msgpack: %w", err)
+	}
+	if d.pos != len(d.data) {
+		return fmt.Errorf("msgpack: %d trailing bytes", len(d.data)-d.pos)
+	}
+
+	return fromValue(tree, target.Elem(), 0)
+}
+
+type msgPackEncoder struct {
+	buf []byte
+}
+
+func (e *msgPackEncoder) encode(tree any) {
+	switch v := tree.(type) {
+	case nil:
+		e.buf = append(e.buf, 0xc0)
+	case bool:
+		if v {
+			e.buf = append(e.buf, 0xc3)
+		} else {
+			e.buf = append(e.buf, 0xc2)
+		}
+	case int64:
+		e.encodeInt(v)
+	case uint64:
+		e.encodeUint(v)
+	case float64:
+		e.buf = binary.BigEndian.AppendUint64(append(e.buf, 0xcb), math.Float64bits(v))
+	case string:
+		e.header(len(v), 0xa0, 31, 0xd9, 0xda, 0xdb)
+		e.buf = append(e.buf, v...)
+	case []byte:
+		e.header(len(v), 0, -1, 0xc4, 0xc5, 0xc6)
+		e.buf = append(e.buf, v...)
+	case []any:
+		e.header(len(v), 0x90, 15, 0, 0xdc, 0xdd)
+		for _, item := range v {
+			e.encode(item)
+		}
+	case mapValue:
+		e.header(len(v), 0x80, 15, 0, 0xde, 0xdf)
+		for _, entry := range v {
+			e.encode(entry.key)
+			e.encode(entry.value)
+		}
+	case time.Time:
+		e.encodeTime(v)
+	}
+}
+
+func (e *msgPackEncoder) encodeInt(v int64) {
+	switch {
+	case v >= 0:
+		e.encodeUint(uint64(v))
+	case v >= -32:
+		e.buf = append(e.buf, byte(int8(v)))
+	case v >= math.MinInt8:
+		e.buf = append(e.buf, 0xd0, byte(int8(v)))
+	case v >= math.MinInt16:
+		e.buf = binary.BigEndian.AppendUint16(append(e.buf, 0xd1), uint16(int16(v)))
+	case v >= math.MinInt32:
+		e.buf = binary.BigEndian.AppendUint32(append(e.buf, 0xd2), uint32(int32(v)))
+	default:
+		e.buf = binary.BigEndian.AppendUint64(append(e.buf, 0xd3), uint64(v))
+	}
+}
+
+func (e *msgPackEncoder) encodeUint(v uint64) {
+	switch {
+	case v <= 0x7f:
+		e.buf = append(e.buf, byte(v))
+	case v <= math.MaxUint8:
+		e.buf = append(e.buf, 0xcc, byte(v))
+	case v <= math.MaxUint16:
+		e.buf = binary.BigEndian.AppendUint16(append(e.buf, 0xcd), uint16(v))
+	case v <= math.MaxUint32:
+		e.buf = binary.BigEndian.AppendUint32(append(e.buf, 0xce), uint32(v))
+	default:
+		e.buf = binary.BigEndian.AppendUint64(append(e.buf, 0xcf), v)
+	}
+}
+
+// header writes the smallest length prefix that fits n.
+func (e *msgPackEncoder) header(n int, fix byte, fixMax int, code8, code16, code32 byte) {
+	switch {
+	case n <= fixMax:
+		e.buf = append(e.buf, fix|byte(n))
+	case n <= math.MaxUint8 && code8 != 0:
+		e.buf = append(e.buf, code8, byte(n))
+	case n <= math.MaxUint16:
+		e.buf = binary.BigEndian.AppendUint16(append(e.buf, code16), uint16(n))
+	default:
+		e.buf = binary.BigEndian.AppendUint32(append(e.buf, code32), uint32(n))
+	}
+}
+
+// encodeTime uses the timestamp extension type in its 32, 64 or 96 bit form.
+func (e *msgPackEncoder) encodeTime(t time.Time) {
+	seconds, nanos := t.Unix(), uint64(t.Nanosecond())
+	if seconds >= 0 && seconds>>34 == 0 {
+		data := nanos<<34 | uint64(seconds)
+		if data>>32 == 0 {
+			e.buf = binary.BigEndian.AppendUint32(append(e.buf, 0xd6, 0xff), uint32(data))
+			return
+		}
+		e.buf = binary.BigEndian.AppendUint64(append(e.buf, 0xd7, 0xff), data)
+		return
+	}
+
+	e.buf = append(e.buf, 0xc7, 12, 0xff)
+	e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(nanos))
+	e.buf = binary.BigEndian.AppendUint64(e.buf, uint64(seconds))
+}
+
+type msgPackDecoder struct {
+	data []byte
+	pos  int
+}
+
+var errTruncated = errors.New("unexpected end of data")
+
+func (d *msgPackDecoder) next(n int) ([]byte, error) {
+	if n < 0 || n > len(d.data)-d.pos {
+		return nil, errTruncated
+	}
+
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *msgPackDecoder) uint(n int) (uint64, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return 0, err
+	}
+
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+func (d *msgPackDecoder) decode(depth int) (any, error) {
+	if depth > maxDepth {
+		return nil, errTooDeep
+	}
+
+	b, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	code := b[0]
+
+	switch {
+	case code <= 0x7f:
+		return int64(code), nil
+	case code >= 0xe0:
+		return int64(int8(code)), nil
+	case code >= 0x80 && code <= 0x8f:
+		return d.decodeMap(int(code&0x0f), depth)
+	case code >= 0x90 && code <= 0x9f:
+		return d.decodeArray(int(code&0x0f), depth)
+	case code >= 0xa0 && code <= 0xbf:
+		return d.decodeString(int(code & 0x1f))
+	}
+
+	switch code {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.uint(1 << (code - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		data, err := d.next(int(n))
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte(nil), data...), nil
+	case 0xc7, 0xc8, 0xc9:
+		n, err := d.uint(1 << (code - 0xc7))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeExt(int(n))
+	case 0xca:
+		bits, err := d.uint(4)
+		return float64(math.Float32frombits(uint32(bits))), err
+	case 0xcb:
+		bits, err := d.uint(8)
+		return math.Float64frombits(bits), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		return d.uint(1 << (code - 0xcc))
+	case 0xd0:
+		v, err := d.uint(1)
+		return int64(int8(v)), err
+	case 0xd1:
+		v, err := d.uint(2)
+		return int64(int16(v)), err
+	case 0xd2:
+		v, err := d.uint(4)
+		return int64(int32(v)), err
+	case 0xd3:
+		v, err := d.uint(8)
+		return int64(v), err
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return d.decodeExt(1 << (code - 0xd4))
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.uint(1 << (code - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeString(int(n))
+	case 0xdc, 0xdd:
+		n, err := d.uint(2 << (code - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeArray(int(n), depth)
+	case 0xde, 0xdf:
+		n, err := d.uint(2 << (code - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeMap(int(n), depth)
+	default:
+		return nil, fmt.Errorf("invalid type code 0x%02x", code)
+	}
+}
+
+func (d *msgPackDecoder) decodeString(n int) (any, error) {
+	data, err := d.next(n)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+func (d *msgPackDecoder) decodeArray(n, depth int) (any, error) {
+	if n > len(d.data)-d.pos {
+		return nil, errTruncated
+	}
+
+	items := make([]any, n)
+	for i := range items {
+		item, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		items[i] = item
+	}
+	return items, nil
+}
+
+func (d *msgPackDecoder) decodeMap(n, depth int) (any, error) {
+	if n > (len(d.data)-d.pos)/2 {
+		return nil, errTruncated
+	}
+
+	entries := make(mapValue, n)
+	for i := range entries {
+		key, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		value, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		entries[i] = mapEntry{key: key, value: value}
+	}
+	return entries, nil
+}
+
+func (d *msgPackDecoder) decodeExt(n int) (any, error) {
+	typ, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	data, err := d.next(n)
+	if err != nil {
+		return nil, err
+	}
+
+	if int8(typ[0]) != msgPackTimestampExt {
+		return nil, fmt.Errorf("unsupported extension type %d", int8(typ[0]))
+	}
+
+	switch n {
+	case 4:
+		return time.Unix(int64(binary.BigEndian.Uint32(data)), 0), nil
+	case 8:
+		v := binary.BigEndian.Uint64(data)
+		return time.Unix(int64(v&(1<<34-1)), int64(v>>34)), nil
+	case 12:
+		nanos := binary.BigEndian.Uint32(data)
+		seconds := int64(binary.BigEndian.Uint64(data[4:]))
+		return time.Unix(seconds, int64(nanos)), nil
+	default:
+		return nil, fmt.Errorf("invalid timestamp length %d", n)
+	}
+}
@@ -0,0 +1,434 @@
+package codec
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The MessagePack and CBOR codecs share one data model. Go values are first flattened into a tree
+// made of nil, bool, int64, uint64, float64, string, []byte, []any, mapValue and time.Time, which
+// each codec then writes in its own wire format; decoding goes the opposite way.
+
+type mapEntry struct {
+	key   any
+	value any
+}
+
+type mapValue []mapEntry
+
+const maxDepth = 256
+
+var (
+	errTooDeep = errors.New("value is nested too deeply")
+	timeType   = reflect.TypeOf(time.Time{})
+)
+
+func toValue(v reflect.Value, depth int) (any, error) {
+	if depth > maxDepth {
+		return nil, errTooDeep
+	}
+
+	if !v.IsValid() {
+		return nil, nil
+	}
+
+	if v.Type() == timeType {
+		return v.Interface().(time.Time), nil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		return v.Bool(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint(), nil
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), nil
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Pointer:
+		if v.IsNil() {
+			return nil, nil
+		}
+		return toValue(v.Elem(), depth+1)
+	case reflect.Interface:
+		// Not a level of nesting of its own, so that anything decoded into an any encodes again.
+		if v.IsNil() {
+			return nil, nil
+		}
+		return toValue(v.Elem(), depth)
+	case reflect.Slice:
+		if v.IsNil() {
+			return nil, nil
+		}
+		fallthrough
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			data := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(data), v)
+			return data, nil
+		}
+
+		items := make([]any, v.Len())
+		for i := range items {
+			item, err := toValue(v.Index(i), depth+1)
+			if err != nil {
+				return nil, err
+			}
+			items[i] = item
+		}
+		return items, nil
+	case reflect.Map:
+		if v.IsNil() {
+			return nil, nil
+		}
+
+		entries := make(mapValue, 0, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			key, err := toValue(iter.Key(), depth+1)
+			if err != nil {
+				return nil, err
+			}
+			value, err := toValue(iter.Value(), depth+1)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, mapEntry{key: key, value: value})
+		}
+		sort.Slice(entries, func(i, j int) bool {
+			return fmt.Sprint(entries[i].key) < fmt.Sprint(entries[j].key)
+		})
+		return entries, nil
+	case reflect.Struct:
+		t := v.Type()
+		entries := make(mapValue, 0, t.NumField())
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+
+			value, err := toValue(v.Field(i), depth+1)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, mapEntry{key: field.Name, value: value})
+		}
+		return entries, nil
+	default:
+		return nil, fmt.Errorf("cannot encode values of type %s", v.Type())
+	}
+}
+
+func fromValue(src any, dst reflect.Value, depth int) error {
+	if depth > maxDepth {
+		return errTooDeep
+	}
+
+	if dst.Type() == timeType {
+		if src == nil {
+			dst.SetZero()
+			return nil
+		}
+
+		t, err := asTime(src)
+		if err != nil {
+			return err
+		}
+		dst.Set(reflect.ValueOf(t))
+		return nil
+	}
+
+	switch dst.Kind() {
+	case reflect.Pointer:
+		if src == nil {
+			dst.SetZero()
+			return nil
+		}
+		if dst.IsNil() {
+			dst.Set(reflect.New(dst.Type().Elem()))
+		}
+		return fromValue(src, dst.Elem(), depth+1)
+	case reflect.Interface:
+		if src == nil {
+			dst.SetZero()
+			return nil
+		}
+
+		natural := reflect.ValueOf(naturalValue(src))
+		if !natural.Type().AssignableTo(dst.Type()) {
+			return mismatch(src, dst)
+		}
+		dst.Set(natural)
+		return nil
+	}
+
+	if src == nil {
+		dst.SetZero()
+		return nil
+	}
+
+	switch dst.Kind() {
+	case reflect.Bool:
+		b, ok := src.(bool)
+		if !ok {
+			return mismatch(src, dst)
+		}
+		dst.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, ok := asInt(src)
+		if !ok || dst.OverflowInt(n) {
+			return mismatch(src, dst)
+		}
+		dst.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, ok := asUint(src)
+		if !ok || dst.OverflowUint(n) {
+			return mismatch(src, dst)
+		}
+		dst.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, ok := asFloat(src)
+		if !ok {
+			return mismatch(src, dst)
+		}
+		dst.SetFloat(f)
+	case reflect.String:
+		switch s := src.(type) {
+		case string:
+			dst.SetString(s)
+		case []byte:
+			dst.SetString(string(s))
+		default:
+			return mismatch(src, dst)
+		}
+	case reflect.Slice:
+		if dst.Type().Elem().Kind() == reflect.Uint8 {
+			data, ok := asBytes(src)
+			if !ok {
+				return mismatch(src, dst)
+			}
+			slice := reflect.MakeSlice(dst.Type(), len(data), len(data))
+			reflect.Copy(slice, reflect.ValueOf(data))
+			dst.Set(slice)
+			return nil
+		}
+
+		items, ok := src.([]any)
+		if !ok {
+			return mismatch(src, dst)
+		}
+		slice := reflect.MakeSlice(dst.Type(), len(items), len(items))
+		for i, item := range items {
+			if err := fromValue(item, slice.Index(i), depth+1); err != nil {
+				return err
+			}
+		}
+		dst.Set(slice)
+	case reflect.Array:
+		if dst.Type().Elem().Kind() == reflect.Uint8 {
+			data, ok := asBytes(src)
+			if !ok || len(data) > dst.Len() {
+				return mismatch(src, dst)
+			}
+			dst.SetZero()
+			reflect.Copy(dst, reflect.ValueOf(data))
+			return nil
+		}
+
+		items, ok := src.([]any)
+		if !ok || len(items) > dst.Len() {
+			return mismatch(src, dst)
+		}
+		dst.SetZero()
+		for i, item := range items {
+			if err := fromValue(item, dst.Index(i), depth+1); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		entries, ok := src.(mapValue)
+		if !ok {
+			return mismatch(src, dst)
+		}
+
+		m := reflect.MakeMapWithSize(dst.Type(), len(entries))
+		for _, entry := range entries {
+			key := reflect.New(dst.Type().Key()).Elem()
+			if err := fromValue(entry.key, key, depth+1); err != nil {
+				return err
+			}
+			value := reflect.New(dst.Type().Elem()).Elem()
+			if err := fromValue(entry.value, value, depth+1); err != nil {
+				return err
+			}
+			m.SetMapIndex(key, value)
+		}
+		dst.Set(m)
+	case reflect.Struct:
+		entries, ok := src.(mapValue)
+		if !ok {
+			return mismatch(src, dst)
+		}
+
+		for _, entry := range entries {
+			name, ok := entry.key.(string)
+			if !ok {
+				continue
+			}
+
+			field, ok := structField(dst.Type(), name)
+			if !ok {
+				continue
+			}
+			if err := fromValue(entry.value, dst.Field(field), depth+1); err != nil {
+				return fmt.Errorf("%s.%s: %w", dst.Type(), name, err)
+			}
+		}
+	default:
+		return fmt.Errorf("cannot decode into values of type %s", dst.Type())
+	}
+
+	return nil
+}
+
+func structField(t reflect.Type, name string) (int, bool) {
+	if field, ok := t.FieldByName(name); ok && field.IsExported() && len(field.Index) == 1 {
+		return field.Index[0], true
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		if field := t.Field(i); field.IsExported() && strings.EqualFold(field.Name, name) {
+			return i, true
+		}
+	}
+
+	return 0, false
+}
+
+// naturalValue converts a decoded tree into the types a caller decoding into `any` would expect.
+func naturalValue(src any) any {
+	switch v := src.(type) {
+	case []any:
+		items := make([]any, len(v))
+		for i, item := range v {
+			items[i] = naturalValue(item)
+		}
+		return items
+	case mapValue:
+		stringKeys := true
+		for _, entry := range v {
+			if _, ok := entry.key.(string); !ok {
+				stringKeys = false
+				break
+			}
+		}
+
+		if stringKeys {
+			m := make(map[string]any, len(v))
+			for _, entry := range v {
+				m[entry.key.(string)] = naturalValue(entry.value)
+			}
+			return m
+		}
+
+		m := make(map[any]any, len(v))
+		for _, entry := range v {
+			key := naturalValue(entry.key)
+			if key != nil && !reflect.TypeOf(key).Comparable() {
+				key = fmt.Sprint(key)
+			}
+			m[key] = naturalValue(entry.value)
+		}
+		return m
+	case uint64:
+		if v <= math.MaxInt64 {
+			return int64(v)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+func mismatch(src any, dst reflect.Value) error {
+	return fmt.Errorf("cannot decode %T into %s", src, dst.Type())
+}
+
+func asInt(src any) (int64, bool) {
+	switch v := src.(type) {
+	case int64:
+		return v, true
+	case uint64:
+		return int64(v), v <= math.MaxInt64
+	case float64:
+		return int64(v), v == math.Trunc(v) && v >= math.MinInt64 && v < math.MaxInt64
+	default:
+		return 0, false
+	}
+}
+
+func asUint(src any) (uint64, bool) {
+	switch v := src.(type) {
+	case uint64:
+		return v, true
+	case int64:
+		return uint64(v), v >= 0
+	case float64:
+		return uint64(v), v == math.Trunc(v) && v >= 0 && v < math.MaxUint64
+	default:
+		return 0, false
+	}
+}
+
+func asFloat(src any) (float64, bool) {
+	switch v := src.(type) {
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	default:
+		return 0, false
+	}
+}
+
+func asBytes(src any) ([]byte, bool) {
+	switch v := src.(type) {
+	case []byte:
+		return v, true
+	case string:
+		return []byte(v), true
+	default:
+		return nil, false
+	}
+}
+
+func asTime(src any) (time.Time, error) {
+	switch v := src.(type) {
+	case time.Time:
+		return v, nil
+	case string:
+		return time.Parse(time.RFC3339Nano, v)
+	case int64:
+		return time.Unix(v, 0), nil
+	case uint64:
+		if v > math.MaxInt64 {
+			return time.Time{}, fmt.Errorf("timestamp %d out of range", v)
+		}
+		return time.Unix(int64(v), 0), nil
+	case float64:
+		seconds, fraction := math.Modf(v)
+		return time.Unix(int64(seconds), int64(fraction*1e9)), nil
+	default:
+		return time.Time{}, fmt.Errorf("cannot decode %T into time.Time", src)
+	}
+}
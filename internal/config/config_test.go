@@ -0,0 +1,191 @@
+package config
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testDefaults = Config{
+	URL:            DefaultURL,
+	Heartbeat:      DefaultHeartbeat,
+	ConnectionName: "default",
+	LogLevel:       "info",
+	LogFormat:      "text",
+	LogFile:        "stderr",
+}
+
+// load runs Load on a fresh flag set, with env as the only PERIL_* variables and file, when set,
+// as the config file.
+func load(t *testing.T, args []string, env map[string]string, file string) (Config, error) {
+	t.Helper()
+
+	for _, variable := range os.Environ() {
+		if name, _, _ := strings.Cut(variable, "="); strings.HasPrefix(name, EnvPrefix) {
+			t.Setenv(name, "")
+			os.Unsetenv(name)
+		}
+	}
+	for name, value := range env {
+		t.Setenv(name, value)
+	}
+	if file != "" {
+		path := filepath.Join(t.TempDir(), "peril.json")
+		if err := os.WriteFile(path, []byte(file), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv(EnvPrefix+"CONFIG", path)
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return Load(fs, args, testDefaults)
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+		args []string
+		want string
+	}{
+		{name: "default", want: "default"},
+		{name: "file", file: `{"connection_name": "file"}`, want: "file"},
+		{name: "env over file", file: `{"connection_name": "file"}`, env: map[string]string{"PERIL_CONNECTION_NAME": "env"}, want: "env"},
+		{name: "flag over env", file: `{"connection_name": "file"}`, env: map[string]string{"PERIL_CONNECTION_NAME": "env"}, args: []string{"-connection-name", "flag"}, want: "flag"},
+		{name: "flag over file", file: `{"connection_name": "file"}`, args: []string{"-connection-name=flag"}, want: "flag"},
+		{name: "empty env still counts", file: `{"connection_name": "file"}`, env: map[string]string{"PERIL_CONNECTION_NAME": ""}, want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := load(t, tt.args, tt.env, tt.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.ConnectionName != tt.want {
+				t.Errorf("connection name %q, want %q", cfg.ConnectionName, tt.want)
+			}
+			// Settings nobody touched keep their defaults.
+			if cfg.URL != DefaultURL || cfg.LogLevel != "info" {
+				t.Errorf("got URL %q and log level %q, want the defaults", cfg.URL, cfg.LogLevel)
+			}
+		})
+	}
+}
+
+func TestLoadHeartbeat(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		env     map[string]string
+		args    []string
+		want    time.Duration
+		wantErr string
+	}{
+		{name: "default", want: 10 * time.Second},
+		{name: "file", file: `{"heartbeat": "30s"}`, want: 30 * time.Second},
+		{name: "env", env: map[string]string{"PERIL_HEARTBEAT": "5s"}, want: 5 * time.Second},
+		{name: "flag", args: []string{"-heartbeat", "1m"}, want: time.Minute},
+		{name: "zero leaves it to the broker", args: []string{"-heartbeat", "0"}, want: 0},
+		{name: "bad in file", file: `{"heartbeat": "often"}`, wantErr: "heartbeat"},
+		{name: "bad in env", env: map[string]string{"PERIL_HEARTBEAT": "10"}, wantErr: "PERIL_HEARTBEAT"},
+		{name: "bad flag", args: []string{"-heartbeat", "often"}, wantErr: "-heartbeat"},
+		{name: "negative", args: []string{"-heartbeat", "-1s"}, wantErr: "negative"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := load(t, tt.args, tt.env, tt.file)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("got %v, want an error about %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Heartbeat != tt.want {
+				t.Errorf("heartbeat %v, want %v", cfg.Heartbeat, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		wantErr string
+	}{
+		{name: "known keys", file: `{"url": "amqp://peril@broker:5672/", "log_level": "debug"}`},
+		{name: "unknown key", file: `{"url": "amqp://peril@broker:5672/", "hearbeat": "10s"}`, wantErr: `unknown setting "hearbeat"`},
+		{name: "flag spelling", file: `{"log-level": "debug"}`, wantErr: `unknown setting "log-level"`},
+		{name: "not an object", file: `["url"]`, wantErr: "peril.json"},
+		{name: "not a string", file: `{"heartbeat": 10}`, wantErr: "peril.json"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := load(t, nil, nil, tt.file)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Error(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got %v, want an error about %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	if _, err := load(t, []string{"-config", filepath.Join(t.TempDir(), "missing.json")}, nil, ""); !os.IsNotExist(err) {
+		t.Errorf("got %v for a missing config file, want it not found", err)
+	}
+}
+
+func TestLoadTLS(t *testing.T) {
+	dir := t.TempDir()
+	pem := map[string]string{}
+	for _, name := range []string{"ca", "cert", "key"} {
+		pem[name] = filepath.Join(dir, name+".pem")
+		if err := os.WriteFile(pem[name], nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr string
+	}{
+		{name: "amqps", args: []string{"-url", "amqps://peril@broker:5671/", "-tls-ca", pem["ca"], "-tls-cert", pem["cert"], "-tls-key", pem["key"]}},
+		{name: "amqps without files", args: []string{"-url", "amqps://peril@broker:5671/"}},
+		{name: "ca without amqps", args: []string{"-tls-ca", pem["ca"]}, wantErr: "amqps://"},
+		{name: "cert without amqps", args: []string{"-tls-cert", pem["cert"], "-tls-key", pem["key"]}, wantErr: "amqps://"},
+		{name: "cert without key", args: []string{"-url", "amqps://peril@broker:5671/", "-tls-cert", pem["cert"]}, wantErr: "go together"},
+		{name: "missing file", args: []string{"-url", "amqps://peril@broker:5671/", "-tls-ca", filepath.Join(dir, "missing.pem")}, wantErr: "missing.pem"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := load(t, tt.args, nil, "")
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Error(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got %v, want an error about %q", err, tt.wantErr)
+			}
+		})
+	}
+}
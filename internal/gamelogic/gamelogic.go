@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
 	"math/rand"
 	"os"
 	"strings"
@@ -18,6 +19,7 @@ func PrintClientHelp() {
 	fmt.Println("    example:")
 	fmt.Println("    spawn europe infantry")
 	fmt.Println("* status")
+	fmt.Println("* players")
 	fmt.Println("* spam <n>")
 	fmt.Println("    example:")
 	fmt.Println("    spam 5")
@@ -28,20 +30,29 @@ func PrintClientHelp() {
 func ClientWelcome() (string, error) {
 	fmt.Println("Welcome to the Peril client!")
 	fmt.Println("Please enter your username:")
-	words := GetInput()
-	if len(words) == 0 {
-		return "", errors.New("you must enter a username. goodbye")
+	for {
+		words := GetInput()
+		if len(words) == 0 {
+			return "", errors.New("you must enter a username. goodbye")
+		}
+		username := words[0]
+		// The username goes into routing keys and queue names, where `.`, `*` and `#` mean something.
+		if err := routing.ValidateUsername(username); err != nil {
+			fmt.Printf("%q can't be used as a username (%v), please pick another:\n", username, err)
+			continue
+		}
+		fmt.Printf("Welcome, %s!\n", username)
+		PrintClientHelp()
+		return username, nil
 	}
-	username := words[0]
-	fmt.Printf("Welcome, %s!\n", username)
-	PrintClientHelp()
-	return username, nil
 }
 
 func PrintServerHelp() {
 	fmt.Println("Possible commands:")
 	fmt.Println("* pause")
 	fmt.Println("* resume")
+	fmt.Println("* stats")
+	fmt.Println("* leader")
 	fmt.Println("* quit")
 	fmt.Println("* help")
 }
@@ -2,33 +2,50 @@ package gamelogic
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
 )
 
-const logsFile = "game.log"
+const LogsFile = "game.log"
+
+// LogSegmentPattern matches the segment files LogSegmentFile names, for globbing.
+const LogSegmentPattern = "game.*.log"
+
+// LogTimeFormat is how each log line starts; the merge in MergeLogs sorts on it.
+const LogTimeFormat = time.RFC3339Nano
 
 const writeToDiskSleep = 1 * time.Second
 
+// LogSegmentFile is the file a server instance that owns one shard of the players writes their logs
+// to. MergeLogs puts the segments back together.
+func LogSegmentFile(shard string) string {
+	return strings.Replace(LogSegmentPattern, "*", shard, 1)
+}
+
 func WriteLog(gamelog routing.GameLog) error {
-	log.Printf("received game log...")
+	return WriteLogFile(LogsFile, gamelog)
+}
+
+func WriteLogFile(path string, gamelog routing.GameLog) error {
+	slog.Debug("Writing game log", "player", gamelog.Username, "file", path)
 	time.Sleep(writeToDiskSleep)
 
-	f, err := os.OpenFile(logsFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		return fmt.Errorf("could not open logs file: %v", err)
 	}
 	defer func(f *os.File) {
 		err := f.Close()
 		if err != nil {
-			log.Printf("could not close logs file: %v", err)
+			slog.Error("Could not close logs file", "error", err)
 		}
 	}(f)
 
-	str := fmt.Sprintf("%v %v: %v\n", gamelog.CurrentTime.Format(time.RFC3339), gamelog.Username, gamelog.Message)
+	str := fmt.Sprintf("%v %v: %v\n", gamelog.CurrentTime.Format(LogTimeFormat), gamelog.Username, gamelog.Message)
 	_, err = f.WriteString(str)
 	if err != nil {
 		return fmt.Errorf("could not write to logs file: %v", err)
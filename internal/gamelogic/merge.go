@@ -0,0 +1,70 @@
+package gamelogic
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// MergeLogs writes the lines of the log files at paths to w ordered by their timestamps. Lines with
+// equal timestamps keep the order they had, taking earlier paths first, so one player's lines, which
+// all sit in the same segment, stay in the order they were written. The segments themselves needn't
+// be in order, since log workers write concurrently.
+func MergeLogs(w io.Writer, paths ...string) error {
+	var lines []logLine
+	for _, path := range paths {
+		read, err := readLogLines(path)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, read...)
+	}
+
+	slices.SortStableFunc(lines, func(a, b logLine) int {
+		return a.at.Compare(b.at)
+	})
+
+	out := bufio.NewWriter(w)
+	for _, line := range lines {
+		if _, err := fmt.Fprintln(out, line.text); err != nil {
+			return err
+		}
+	}
+
+	return out.Flush()
+}
+
+type logLine struct {
+	text string
+	at   time.Time
+}
+
+func readLogLines(path string) ([]logLine, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []logLine
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		text := scanner.Text()
+		if text == "" {
+			continue
+		}
+
+		stamp, _, _ := strings.Cut(text, " ")
+		at, err := time.Parse(LogTimeFormat, stamp)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: line doesn't start with a timestamp: %w", path, lineNo, err)
+		}
+		lines = append(lines, logLine{text: text, at: at})
+	}
+
+	return lines, scanner.Err()
+}
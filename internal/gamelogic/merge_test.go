@@ -0,0 +1,84 @@
+package gamelogic
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeSegment(t *testing.T, dir, name string, lines ...string) string {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestMergeLogs(t *testing.T) {
+	base := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	at := func(offset time.Duration) string {
+		return base.Add(offset).Format(LogTimeFormat)
+	}
+
+	dir := t.TempDir()
+	// Workers write concurrently, so a segment's lines needn't be in order.
+	a := writeSegment(t, dir, "a.log",
+		at(3*time.Second)+" washington: third",
+		at(time.Second)+" washington: first",
+		"",
+		at(5*time.Second)+" washington: same instant, earlier segment",
+		at(5*time.Second)+" washington: same instant, later line",
+	)
+	b := writeSegment(t, dir, "b.log",
+		at(2*time.Second)+" lincoln: second",
+		at(5*time.Second)+" lincoln: same instant, later segment",
+		// Nanosecond timestamps still sort by time, not as text.
+		at(4*time.Second+time.Nanosecond)+" lincoln: fourth",
+	)
+
+	var out strings.Builder
+	if err := MergeLogs(&out, a, b); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"washington: first",
+		"lincoln: second",
+		"washington: third",
+		"lincoln: fourth",
+		"washington: same instant, earlier segment",
+		"washington: same instant, later line",
+		"lincoln: same instant, later segment",
+	}
+	got := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(got) != len(want) {
+		t.Fatalf("got %d lines, want %d:\n%s", len(got), len(want), out.String())
+	}
+	for i, line := range got {
+		if _, text, _ := strings.Cut(line, " "); text != want[i] {
+			t.Errorf("line %d is %q, want %q", i, text, want[i])
+		}
+	}
+}
+
+func TestMergeLogsErrors(t *testing.T) {
+	dir := t.TempDir()
+	good := writeSegment(t, dir, "good.log", time.Now().Format(LogTimeFormat)+" washington: fine")
+	bad := writeSegment(t, dir, "bad.log", time.Now().Format(LogTimeFormat)+" washington: fine", "no timestamp here")
+
+	var out strings.Builder
+	if err := MergeLogs(&out, good, bad); err == nil || !strings.Contains(err.Error(), "bad.log:2") {
+		t.Errorf("got %v, want the bad line pointed out", err)
+	}
+	if err := MergeLogs(&out, good, filepath.Join(dir, "missing.log")); !os.IsNotExist(err) {
+		t.Errorf("got %v for a missing segment, want it not found", err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("wrote %q before failing, want nothing", out.String())
+	}
+}
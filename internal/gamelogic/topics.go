@@ -0,0 +1,26 @@
+package gamelogic
+
+import (
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/codec"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// The game's own payloads live here rather than in routing, which gamelogic depends on.
+var (
+	// ArmyMoves carries every move to every player, each consuming from a queue of their own.
+	ArmyMoves = routing.Topic[ArmyMove]{
+		Exchange: routing.ExchangePerilTopic,
+		Pattern:  routing.ArmyMovesPrefix + ".*",
+		Queue:    routing.ArmyMovesPrefix + ".*",
+		Codec:    codec.JSON,
+	}
+
+	// WarRecognitions carries wars to a queue shared by all players, so each is fought once.
+	WarRecognitions = routing.Topic[RecognitionOfWar]{
+		Exchange: routing.ExchangePerilTopic,
+		Pattern:  routing.WarRecognitionsPrefix + ".*",
+		Queue:    routing.WarRecognitionsPrefix,
+		Codec:    codec.JSON,
+		Durable:  true,
+	}
+)
@@ -0,0 +1,129 @@
+package gamelogic
+
+import (
+	"context"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	"testing"
+	"time"
+)
+
+func receive[T any](t *testing.T, messages <-chan T) T {
+	t.Helper()
+
+	select {
+	case message := <-messages:
+		return message
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for a message")
+	}
+
+	var zero T
+	return zero
+}
+
+func newPlayer(t *testing.T, username string, commands ...[]string) *GameState {
+	t.Helper()
+
+	state := NewGameState(username)
+	for _, command := range commands {
+		if err := state.CommandSpawn(command); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return state
+}
+
+// TestMoveToWar plays a move that lands one player's units on another's, through the broker, until
+// the war is fought.
+func TestMoveToWar(t *testing.T) {
+	ctx := context.Background()
+	broker := pubsub.NewMemoryBroker()
+	if err := pubsub.ApplyTopology(broker, routing.PerilTopology); err != nil {
+		t.Fatal(err)
+	}
+	publisher, err := broker.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+
+	washington := newPlayer(t, "washington", []string{"spawn", "europe", RankArtillery})
+	lincoln := newPlayer(t, "lincoln", []string{"spawn", "asia", RankInfantry})
+
+	moves := make(chan MoveOutcome, 1)
+	moveSubscription, err := pubsub.Bind(ArmyMoves).SubscribeMessage(ctx, broker, []string{"washington"}, func(message pubsub.Message[ArmyMove]) pubsub.AckType {
+		params, err := ArmyMoves.Params(message.RoutingKey)
+		if err != nil || params[0] != message.Body.Player.Username {
+			t.Errorf("move from %s published under %q", message.Body.Player.Username, message.RoutingKey)
+		}
+
+		outcome := washington.HandleMove(message.Body)
+		if outcome == MoveOutcomeMakeWar {
+			err := pubsub.Bind(WarRecognitions).Publish(ctx, publisher, []string{"washington"}, RecognitionOfWar{
+				Attacker: message.Body.Player,
+				Defender: washington.GetPlayerSnap(),
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}
+		moves <- outcome
+		return pubsub.Ack
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer moveSubscription.Close()
+
+	type result struct {
+		outcome WarOutcome
+		winner  string
+	}
+	wars := make(chan result, 1)
+	warSubscription, err := pubsub.Bind(WarRecognitions).Subscribe(ctx, broker, nil, func(war RecognitionOfWar) pubsub.AckType {
+		outcome, winner, _ := lincoln.HandleWar(war)
+		wars <- result{outcome, winner}
+		return pubsub.Ack
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer warSubscription.Close()
+
+	move, err := lincoln.CommandMove([]string{"move", "europe", "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pubsub.Bind(ArmyMoves).Publish(ctx, publisher, []string{"lincoln"}, move); err != nil {
+		t.Fatal(err)
+	}
+
+	if outcome := receive(t, moves); outcome != MoveOutcomeMakeWar {
+		t.Fatalf("move outcome %v, want war", outcome)
+	}
+	war := receive(t, wars)
+	if war.outcome != WarOutcomeOpponentWon || war.winner != "washington" {
+		t.Errorf("war went %v to %q, want washington's artillery to beat lincoln's infantry", war.outcome, war.winner)
+	}
+	if _, ok := lincoln.GetUnit(1); ok {
+		t.Error("lincoln's defeated unit survived")
+	}
+}
+
+func TestTopicKeys(t *testing.T) {
+	key, err := ArmyMoves.Key("washington")
+	if err != nil || key != "army_moves.washington" {
+		t.Errorf("got key %q, %v, want army_moves.washington", key, err)
+	}
+	if _, err := ArmyMoves.Key("george.washington"); err == nil {
+		t.Error("built a key from a parameter containing a dot")
+	}
+	if _, err := ArmyMoves.Key(); err == nil {
+		t.Error("built a key without its parameter")
+	}
+	if _, err := WarRecognitions.QueueName("extra"); err == nil {
+		t.Error("built a queue name with a parameter it doesn't take")
+	}
+}
@@ -0,0 +1,98 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/tracing"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Options picks where diagnostic logs go and what they look like.
+type Options struct {
+	// Level is debug, info, warn or error. It defaults to info.
+	Level string
+	// Format is text or json. It defaults to text.
+	Format string
+	// Output is stderr, stdout or the path of a file to append to. It defaults to stderr.
+	Output string
+}
+
+// Setup installs a slog logger built from options as the default, which log.Printf also writes
+// through. Records logged with a context that is in a trace carry its trace and span IDs. Close the
+// returned closer on exit to close the log file.
+func Setup(options Options) (io.Closer, error) {
+	level, err := ParseLevel(options.Level)
+	if err != nil {
+		return nil, err
+	}
+
+	var w io.Writer
+	var closer io.Closer = nopCloser{}
+	switch options.Output {
+	case "", "stderr":
+		w = os.Stderr
+	case "stdout":
+		w = os.Stdout
+	default:
+		file, err := os.OpenFile(options.Output, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		w, closer = file, file
+	}
+
+	handlerOptions := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch strings.ToLower(options.Format) {
+	case "", "text":
+		handler = slog.NewTextHandler(w, handlerOptions)
+	case "json":
+		handler = slog.NewJSONHandler(w, handlerOptions)
+	default:
+		closer.Close()
+		return nil, fmt.Errorf("unknown log format %q, want text or json", options.Format)
+	}
+
+	slog.SetDefault(slog.New(traceHandler{handler}))
+	return closer, nil
+}
+
+func ParseLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if s == "" {
+		return slog.LevelInfo, nil
+	}
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return level, fmt.Errorf("unknown log level %q, want debug, info, warn or error", s)
+	}
+
+	return level, nil
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
+
+// traceHandler adds the trace and span IDs of the record's context.
+type traceHandler struct {
+	slog.Handler
+}
+
+func (h traceHandler) Handle(ctx context.Context, record slog.Record) error {
+	if sc, ok := tracing.FromContext(ctx); ok {
+		record.AddAttrs(slog.String("trace_id", sc.TraceID.String()), slog.String("span_id", sc.SpanID.String()))
+	}
+
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h traceHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return traceHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h traceHandler) WithGroup(name string) slog.Handler {
+	return traceHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,176 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUnroutable = errors.New("message could not be routed to any queue")
+	ErrNacked     = errors.New("message was rejected by the broker")
+)
+
+type UnroutableError struct {
+	Exchange   string
+	RoutingKey string
+	ReplyCode  uint16
+	ReplyText  string
+}
+
+func (e *UnroutableError) Error() string {
+	return fmt.Sprintf("message to exchange %q with key %q was returned: %d %s", e.Exchange, e.RoutingKey, e.ReplyCode, e.ReplyText)
+}
+
+func (e *UnroutableError) Is(target error) bool {
+	return target == ErrUnroutable
+}
+
+type ConfirmOptions struct {
+	// Mandatory makes the broker return messages that match no queue, surfaced as ErrUnroutable.
+	Mandatory bool
+	// Timeout bounds the wait for a confirmation when the caller's context has no deadline.
+	Timeout time.Duration
+}
+
+// ConfirmedPublisher puts a channel in confirm mode and makes every publish wait for the broker's
+// ack or nack. Publishes are serialized so that returns and confirmations can be matched up.
+type ConfirmedPublisher struct {
+	mu       sync.Mutex
+	channel  Channel
+	options  ConfirmOptions
+	confirms chan amqp.Confirmation
+	returns  chan amqp.Return
+	sequence uint64
+}
+
+func NewConfirmedPublisher(channel Channel, options ConfirmOptions) (*ConfirmedPublisher, error) {
+	p := &ConfirmedPublisher{
+		channel:  channel,
+		options:  options,
+		confirms: channel.NotifyPublish(make(chan amqp.Confirmation, 16)),
+		returns:  channel.NotifyReturn(make(chan amqp.Return, 16)),
+	}
+
+	if err := channel.Confirm(false); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func (p *ConfirmedPublisher) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	return p.publishAll(ctx, []outgoing{{exchange: exchange, key: key, mandatory: mandatory, immediate: immediate, publishing: msg}})
+}
+
+type outgoing struct {
+	exchange   string
+	key        string
+	mandatory  bool
+	immediate  bool
+	publishing amqp.Publishing
+}
+
+// publishAll publishes back to back and then waits for every confirmation.
+func (p *ConfirmedPublisher) publishAll(ctx context.Context, messages []outgoing) error {
+	if _, ok := ctx.Deadline(); !ok && p.options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.options.Timeout)
+		defer cancel()
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	first := p.sequence + 1
+	pending := 0
+	returns := p.returns
+	var failed error
+
+	unroutable := func(r amqp.Return) {
+		if failed == nil {
+			failed = &UnroutableError{
+				Exchange:   r.Exchange,
+				RoutingKey: r.RoutingKey,
+				ReplyCode:  r.ReplyCode,
+				ReplyText:  r.ReplyText,
+			}
+		}
+	}
+	confirmed := func(confirmation amqp.Confirmation) {
+		// Confirmations for earlier publishes that timed out; any return seen so far was theirs.
+		if confirmation.DeliveryTag < first {
+			if pending == int(p.sequence-first+1) {
+				failed = nil
+			}
+			return
+		}
+
+		pending--
+		if !confirmation.Ack && failed == nil {
+			failed = ErrNacked
+		}
+	}
+
+	for _, m := range messages {
+		if err := p.channel.PublishWithContext(ctx, m.exchange, m.key, m.mandatory || p.options.Mandatory, m.immediate, m.publishing); err != nil {
+			return err
+		}
+		p.sequence++
+		pending++
+
+	drain:
+		for {
+			select {
+			case r, ok := <-returns:
+				if !ok {
+					returns = nil
+					continue
+				}
+				unroutable(r)
+			case confirmation, ok := <-p.confirms:
+				if !ok {
+					return amqp.ErrClosed
+				}
+				confirmed(confirmation)
+			default:
+				break drain
+			}
+		}
+	}
+
+	for pending > 0 {
+		select {
+		case r, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			unroutable(r)
+		case confirmation, ok := <-p.confirms:
+			if !ok {
+				return amqp.ErrClosed
+			}
+			confirmed(confirmation)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	// The broker sends basic.return before the matching basic.ack, but the two arrive on different
+	// notification channels, so pick up a return that lost the race.
+	if failed == nil {
+		select {
+		case r, ok := <-returns:
+			if ok {
+				unroutable(r)
+			}
+		default:
+		}
+	}
+
+	return failed
+}
@@ -0,0 +1,105 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	"testing"
+	"time"
+)
+
+func TestConfirmedPublisher(t *testing.T) {
+	tests := []struct {
+		name       string
+		options    ConfirmOptions
+		key        string
+		publish    []PublishOption
+		unroutable bool
+	}{
+		{name: "routed", key: "test_confirm.washington"},
+		{name: "routed mandatory", key: "test_confirm.washington", publish: []PublishOption{WithMandatory()}},
+		{name: "unroutable", key: "nobody.listens"},
+		{name: "unroutable mandatory", key: "nobody.listens", publish: []PublishOption{WithMandatory()}, unroutable: true},
+		{name: "unroutable mandatory by default", options: ConfirmOptions{Mandatory: true}, key: "nobody.listens", unroutable: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := newTestBroker(t)
+			channel := newTestChannel(t, broker)
+			if _, _, err := DeclareAndBind(broker, routing.ExchangePerilTopic, "test_confirm", "test_confirm.*", QueueTypeDurable); err != nil {
+				t.Fatal(err)
+			}
+
+			tt.options.Timeout = testTimeout
+			publisher, err := NewConfirmedPublisher(channel, tt.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = Publish(context.Background(), publisher, routing.ExchangePerilTopic, tt.key, testMove{Player: "washington"}, tt.publish...)
+			if !tt.unroutable {
+				if err != nil {
+					t.Fatalf("got %v, want the publish confirmed", err)
+				}
+				if depth, _ := queueDepth(t, broker, "test_confirm"); (depth == 1) != (tt.key == "test_confirm.washington") {
+					t.Errorf("queue holds %d messages after publishing with key %q", depth, tt.key)
+				}
+				return
+			}
+
+			if !errors.Is(err, ErrUnroutable) {
+				t.Fatalf("got %v, want ErrUnroutable", err)
+			}
+			var unroutable *UnroutableError
+			if !errors.As(err, &unroutable) || unroutable.Exchange != routing.ExchangePerilTopic || unroutable.RoutingKey != tt.key {
+				t.Errorf("got %v, want the exchange and key that could not be routed", err)
+			}
+		})
+	}
+}
+
+// TestConfirmedPublisherAfterReturn checks a return is only blamed on the publish it belongs to.
+func TestConfirmedPublisherAfterReturn(t *testing.T) {
+	broker := newTestBroker(t)
+	if _, _, err := DeclareAndBind(broker, routing.ExchangePerilTopic, "test_confirm", "test_confirm.*", QueueTypeDurable); err != nil {
+		t.Fatal(err)
+	}
+	publisher, err := NewConfirmedPublisher(newTestChannel(t, broker), ConfirmOptions{Mandatory: true, Timeout: testTimeout})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, tt := range []struct {
+		key        string
+		unroutable bool
+	}{
+		{"nobody.listens", true},
+		{"test_confirm.washington", false},
+		{"nobody.listens", true},
+		{"nobody.listens", true},
+		{"test_confirm.lincoln", false},
+	} {
+		err := Publish(context.Background(), publisher, routing.ExchangePerilTopic, tt.key, testMove{})
+		if tt.unroutable && !errors.Is(err, ErrUnroutable) || !tt.unroutable && err != nil {
+			t.Errorf("publish %d with key %q: got %v, want unroutable %v", i, tt.key, err, tt.unroutable)
+		}
+	}
+}
+
+func TestConfirmedPublisherClosedChannel(t *testing.T) {
+	broker := newTestBroker(t)
+	channel, err := broker.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	publisher, err := NewConfirmedPublisher(channel, ConfirmOptions{Timeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	channel.Close()
+
+	if err := Publish(context.Background(), publisher, routing.ExchangePerilTopic, "test_confirm.washington", testMove{}); err == nil {
+		t.Error("publish on a closed channel succeeded")
+	}
+}
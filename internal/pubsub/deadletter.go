@@ -0,0 +1,121 @@
+package pubsub
+
+import (
+	amqp "github.com/rabbitmq/amqp091-go"
+	"strings"
+	"time"
+)
+
+// Death is one x-death entry: a queue the message was dead-lettered from, why, and how often.
+type Death struct {
+	Queue       string
+	Reason      string
+	Exchange    string
+	RoutingKeys []string
+	Count       int64
+	Time        time.Time
+}
+
+// DeadLetter is a message taken from a dead-letter queue, with the broker's and our own
+// bookkeeping headers unpacked.
+type DeadLetter struct {
+	Delivery amqp.Delivery
+	Deaths   []Death
+	// OriginalExchange and OriginalRoutingKey are where the message was first published, which is
+	// where a replay sends it back to.
+	OriginalExchange   string
+	OriginalRoutingKey string
+	// DecodeError is set for messages quarantined because they could not be decoded.
+	DecodeError string
+}
+
+func NewDeadLetter(delivery amqp.Delivery) DeadLetter {
+	letter := DeadLetter{
+		Delivery:           delivery,
+		OriginalExchange:   delivery.Exchange,
+		OriginalRoutingKey: delivery.RoutingKey,
+	}
+	letter.DecodeError, _ = delivery.Headers[HeaderDecodeError].(string)
+
+	deaths, _ := delivery.Headers["x-death"].([]interface{})
+	for _, entry := range deaths {
+		table, ok := entry.(amqp.Table)
+		if !ok {
+			continue
+		}
+
+		death := Death{}
+		death.Queue, _ = table["queue"].(string)
+		death.Reason, _ = table["reason"].(string)
+		death.Exchange, _ = table["exchange"].(string)
+		death.Count, _ = tableInt(table, "count")
+		death.Time, _ = table["time"].(time.Time)
+		keys, _ := table["routing-keys"].([]interface{})
+		for _, key := range keys {
+			if key, ok := key.(string); ok {
+				death.RoutingKeys = append(death.RoutingKeys, key)
+			}
+		}
+		letter.Deaths = append(letter.Deaths, death)
+	}
+
+	// x-death is newest first, so the last entry is where the message first died.
+	if len(letter.Deaths) > 0 {
+		first := letter.Deaths[len(letter.Deaths)-1]
+		letter.OriginalExchange = first.Exchange
+		if len(first.RoutingKeys) > 0 {
+			letter.OriginalRoutingKey = first.RoutingKeys[0]
+		}
+	}
+
+	// The broker's own record doesn't survive retry queues.
+	if exchange, ok := delivery.Headers[HeaderOriginalExchange].(string); ok {
+		letter.OriginalExchange = exchange
+	}
+	if key, ok := delivery.Headers[HeaderOriginalRoutingKey].(string); ok {
+		letter.OriginalRoutingKey = key
+	}
+
+	return letter
+}
+
+// Replay is the message as it should be republished to its original destination: the body and
+// properties unchanged, minus the headers recording how it died and how often it was retried.
+func (l DeadLetter) Replay() amqp.Publishing {
+	headers := amqp.Table{}
+	for k, v := range l.Delivery.Headers {
+		if strings.HasPrefix(k, "x-death") || strings.HasPrefix(k, "x-first-death-") || strings.HasPrefix(k, "x-last-death-") {
+			continue
+		}
+		switch k {
+		case HeaderDecodeError, HeaderTargetType, HeaderOriginalExchange, HeaderOriginalRoutingKey, HeaderOriginalQueue, HeaderRetryCount:
+			continue
+		}
+		headers[k] = v
+	}
+
+	return republishing(l.Delivery, headers)
+}
+
+// Copy is the message exactly as it sits in the dead-letter queue, headers included, for moving it
+// somewhere else without losing its history.
+func (l DeadLetter) Copy() amqp.Publishing {
+	return republishing(l.Delivery, l.Delivery.Headers)
+}
+
+// republishing copies a delivery's body and properties into a new message with the given headers.
+func republishing(delivery amqp.Delivery, headers amqp.Table) amqp.Publishing {
+	return amqp.Publishing{
+		Headers:         headers,
+		ContentType:     delivery.ContentType,
+		ContentEncoding: delivery.ContentEncoding,
+		DeliveryMode:    delivery.DeliveryMode,
+		Priority:        delivery.Priority,
+		CorrelationId:   delivery.CorrelationId,
+		MessageId:       delivery.MessageId,
+		Timestamp:       delivery.Timestamp,
+		Type:            delivery.Type,
+		AppId:           delivery.AppId,
+		Body:            delivery.Body,
+	}
+}
@@ -0,0 +1,218 @@
+package pubsub
+
+import (
+	"bufio"
+	"container/list"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DedupeStore remembers which messages have been processed, so redeliveries can be skipped.
+type DedupeStore interface {
+	// Seen reports whether key was marked within the store's window.
+	Seen(key string) (bool, error)
+	// Mark records key as processed now.
+	Mark(key string) error
+}
+
+// MemoryDedupeStore keeps the most recently processed keys in memory, forgetting the oldest once it
+// holds capacity keys or when they fall out of the window.
+type MemoryDedupeStore struct {
+	capacity int
+	window   time.Duration
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type dedupeEntry struct {
+	key      string
+	markedAt time.Time
+}
+
+func NewMemoryDedupeStore(capacity int, window time.Duration) *MemoryDedupeStore {
+	return &MemoryDedupeStore{
+		capacity: capacity,
+		window:   window,
+		order:    list.New(),
+		entries:  map[string]*list.Element{},
+	}
+}
+
+func (s *MemoryDedupeStore) Seen(key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	element, ok := s.entries[key]
+	if !ok {
+		return false, nil
+	}
+
+	if time.Since(element.Value.(dedupeEntry).markedAt) > s.window {
+		s.order.Remove(element)
+		delete(s.entries, key)
+		return false, nil
+	}
+
+	return true, nil
+}
+
+func (s *MemoryDedupeStore) Mark(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.markLocked(key, time.Now())
+	return nil
+}
+
+func (s *MemoryDedupeStore) markLocked(key string, markedAt time.Time) {
+	if element, ok := s.entries[key]; ok {
+		s.order.Remove(element)
+	}
+	s.entries[key] = s.order.PushFront(dedupeEntry{key: key, markedAt: markedAt})
+
+	for s.order.Len() > s.capacity {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.entries, oldest.Value.(dedupeEntry).key)
+	}
+}
+
+// live lists the keys still within the window, oldest first.
+func (s *MemoryDedupeStore) live() []dedupeEntry {
+	var entries []dedupeEntry
+	for element := s.order.Back(); element != nil; element = element.Prev() {
+		if entry := element.Value.(dedupeEntry); time.Since(entry.markedAt) <= s.window {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries
+}
+
+// FileDedupeStore is a MemoryDedupeStore that also appends every mark to a file, so processed
+// keys survive a restart. The file is compacted down to the live keys when it is opened and
+// whenever it grows to twice the store's capacity.
+type FileDedupeStore struct {
+	*MemoryDedupeStore
+
+	path    string
+	file    *os.File
+	written int
+}
+
+func NewFileDedupeStore(path string, capacity int, window time.Duration) (*FileDedupeStore, error) {
+	store := &FileDedupeStore{MemoryDedupeStore: NewMemoryDedupeStore(capacity, window), path: path}
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if err := store.compactLocked(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// load replays the file. Each line is a mark: the time in Unix nanoseconds, a space and the key.
+func (s *FileDedupeStore) load() error {
+	file, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		nanos, key, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			continue
+		}
+		unixNanos, err := strconv.ParseInt(nanos, 10, 64)
+		if err != nil {
+			continue
+		}
+		s.markLocked(key, time.Unix(0, unixNanos))
+	}
+
+	return scanner.Err()
+}
+
+func (s *FileDedupeStore) Mark(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	markedAt := time.Now()
+	s.markLocked(key, markedAt)
+
+	if s.written >= 2*s.capacity {
+		return s.compactLocked()
+	}
+
+	if _, err := fmt.Fprintf(s.file, "%d %s\n", markedAt.UnixNano(), key); err != nil {
+		return err
+	}
+	s.written++
+
+	return nil
+}
+
+// compactLocked rewrites the file with only the live keys and swaps it in atomically.
+func (s *FileDedupeStore) compactLocked() error {
+	tmp := s.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(file)
+	live := s.live()
+	for _, entry := range live {
+		fmt.Fprintf(writer, "%d %s\n", entry.markedAt.UnixNano(), entry.key)
+	}
+	if err = writer.Flush(); err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+
+	if s.file != nil {
+		s.file.Close()
+	}
+	if s.file, err = os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0644); err != nil {
+		return err
+	}
+	s.written = len(live)
+
+	return nil
+}
+
+func (s *FileDedupeStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.file.Close()
+}
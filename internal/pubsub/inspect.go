@@ -0,0 +1,70 @@
+package pubsub
+
+import (
+	"errors"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"time"
+)
+
+// QueueStats is what the broker reports about a queue at one moment.
+type QueueStats struct {
+	Name string
+	// Messages counts messages ready for delivery. Ones delivered but not yet acknowledged are not
+	// included.
+	Messages  int
+	Consumers int
+	// Missing is set when the queue doesn't exist; the counts are then zero.
+	Missing bool
+	At      time.Time
+}
+
+// GrowthRate is how many messages per second the queue gained since previous, which must be a
+// sample of the same queue. It is negative while the queue drains.
+func (s QueueStats) GrowthRate(previous QueueStats) float64 {
+	elapsed := s.At.Sub(previous.At).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+
+	return float64(s.Messages-previous.Messages) / elapsed
+}
+
+// Inspect reads the depth and consumer count of each queue with a passive declare, which never
+// creates or changes anything. A queue that doesn't exist is reported as Missing rather than
+// failing the whole inspection.
+func Inspect(broker Broker, queues ...string) ([]QueueStats, error) {
+	var channel Channel
+	defer func() {
+		if channel != nil {
+			channel.Close()
+		}
+	}()
+
+	stats := make([]QueueStats, 0, len(queues))
+	for _, name := range queues {
+		if channel == nil {
+			var err error
+			if channel, err = broker.Channel(); err != nil {
+				return nil, err
+			}
+		}
+
+		queue, err := channel.QueueDeclarePassive(name, false, false, false, false, nil)
+		now := time.Now()
+
+		var amqpErr *amqp.Error
+		switch {
+		case err == nil:
+			stats = append(stats, QueueStats{Name: name, Messages: queue.Messages, Consumers: queue.Consumers, At: now})
+		case errors.As(err, &amqpErr) && amqpErr.Code == amqp.NotFound:
+			// The broker closed the channel over the failed declare.
+			channel.Close()
+			channel = nil
+			stats = append(stats, QueueStats{Name: name, Missing: true, At: now})
+		default:
+			return nil, err
+		}
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,217 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// electionTimeout is how many ping intervals a leader goes without a ping before it steps down.
+const electionTimeout = 3
+
+// Election picks one leader among the processes contending for the same lock queue and fails over
+// to another when the leader goes away. The lock is a single-active-consumer queue: every candidate
+// consumes from it and pings it every interval, and the broker delivers to one consumer at a time,
+// so the candidate receiving the pings is the leader. When the leader's connection dies, the broker
+// hands the queue to the candidate that has waited longest, which then starts receiving pings.
+//
+// A leader on a ManagedConnection steps down as soon as its connection drops. One cut off from the
+// broker without noticing only steps down once pings have stopped for a few intervals, and until
+// then two processes may both believe they lead.
+type Election struct {
+	Queue string
+	// ID names this candidate in the pings it sends.
+	ID string
+
+	interval time.Duration
+	onChange func(leader bool)
+
+	mu         sync.Mutex
+	leader     bool
+	candidates map[string]time.Time
+	err        error
+
+	lost   chan chan struct{}
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Elect joins the election held on queue and keeps taking part until ctx is cancelled or Close is
+// called. onChange, if not nil, is called from the election's goroutine whenever this process
+// becomes or stops being the leader; it stops being the leader when the election ends.
+func Elect(ctx context.Context, broker Broker, queue string, interval time.Duration, onChange func(leader bool)) (*Election, error) {
+	channel, err := broker.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = channel.QueueDeclare(queue, false, false, false, false, amqp.Table{
+		headerSingleActiveConsumer: true,
+		// Pings only mean something while they are fresh.
+		headerMessageTTL: (electionTimeout * interval).Milliseconds(),
+	})
+	if err != nil {
+		channel.Close()
+		return nil, err
+	}
+
+	deliveries, err := channel.Consume(queue, newConsumerTag(queue), true, false, false, false, nil)
+	if err != nil {
+		channel.Close()
+		return nil, err
+	}
+
+	hostname, _ := os.Hostname()
+	ctx, cancel := context.WithCancel(ctx)
+	e := &Election{
+		Queue:      queue,
+		ID:         fmt.Sprintf("%s:%d", hostname, os.Getpid()),
+		interval:   interval,
+		onChange:   onChange,
+		candidates: map[string]time.Time{},
+		lost:       make(chan chan struct{}),
+		cancel:     cancel,
+		done:       make(chan struct{}),
+	}
+	if managed, ok := broker.(*ManagedConnection); ok {
+		// The lock passes on the moment the connection drops.
+		managed.onLost(e.connectionLost)
+	}
+	go e.run(ctx, channel, deliveries)
+
+	return e, nil
+}
+
+func (e *Election) run(ctx context.Context, channel Channel, deliveries <-chan amqp.Delivery) {
+	defer close(e.done)
+	defer channel.Close()
+
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	e.ping(ctx, channel)
+	for {
+		select {
+		case <-ctx.Done():
+			e.setLeader(false)
+			return
+		case stepped := <-e.lost:
+			e.setLeader(false)
+			close(stepped)
+		case delivery, ok := <-deliveries:
+			if !ok {
+				e.mu.Lock()
+				e.err = ErrConsumerClosed
+				e.mu.Unlock()
+				e.setLeader(false)
+				return
+			}
+			e.received(string(delivery.Body))
+		case <-ticker.C:
+			e.ping(ctx, channel)
+			e.expire()
+		}
+	}
+}
+
+// connectionLost steps down and waits until the leader's duties have stopped.
+func (e *Election) connectionLost() {
+	stepped := make(chan struct{})
+	select {
+	case e.lost <- stepped:
+		<-stepped
+	case <-e.done:
+	}
+}
+
+func (e *Election) ping(ctx context.Context, channel Channel) {
+	err := channel.PublishWithContext(ctx, "", e.Queue, false, false, amqp.Publishing{
+		Timestamp: time.Now(),
+		Body:      []byte(e.ID),
+	})
+	if err != nil {
+		slog.Warn("Could not send election ping", "queue", e.Queue, "error", err)
+	}
+}
+
+func (e *Election) received(candidate string) {
+	e.mu.Lock()
+	e.candidates[candidate] = time.Now()
+	e.mu.Unlock()
+
+	e.setLeader(true)
+}
+
+// expire forgets candidates that stopped pinging and steps down when no pings arrive at all.
+func (e *Election) expire() {
+	cutoff := time.Now().Add(-electionTimeout * e.interval)
+
+	e.mu.Lock()
+	for candidate, seen := range e.candidates {
+		if seen.Before(cutoff) {
+			delete(e.candidates, candidate)
+		}
+	}
+	stale := len(e.candidates) == 0
+	e.mu.Unlock()
+
+	if stale {
+		e.setLeader(false)
+	}
+}
+
+func (e *Election) setLeader(leader bool) {
+	e.mu.Lock()
+	changed := e.leader != leader
+	e.leader = leader
+	if !leader {
+		e.candidates = map[string]time.Time{}
+	}
+	e.mu.Unlock()
+
+	if changed {
+		slog.Info("Leadership changed", "queue", e.Queue, "leader", leader)
+		if e.onChange != nil {
+			e.onChange(leader)
+		}
+	}
+}
+
+func (e *Election) IsLeader() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.leader
+}
+
+// Candidates lists the processes taking part in the election, including this one. Only the leader
+// hears from the others, so it is empty on every other process.
+func (e *Election) Candidates() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	candidates := make([]string, 0, len(e.candidates))
+	for candidate := range e.candidates {
+		candidates = append(candidates, candidate)
+	}
+	sort.Strings(candidates)
+
+	return candidates
+}
+
+// Close leaves the election, stepping down first if this process leads, so the broker can hand the
+// lock to another candidate straight away.
+func (e *Election) Close() error {
+	e.cancel()
+	<-e.done
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.err
+}
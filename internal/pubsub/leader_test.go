@@ -0,0 +1,74 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+const testElectionInterval = 10 * time.Millisecond
+
+// elect joins the test election and reports its leadership changes on the returned channel.
+func elect(t *testing.T, broker Broker) (*Election, <-chan bool) {
+	t.Helper()
+
+	changes := make(chan bool, 10)
+	election, err := Elect(context.Background(), broker, "test_leader", testElectionInterval, func(leader bool) {
+		changes <- leader
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { election.Close() })
+
+	return election, changes
+}
+
+func TestElectionHandover(t *testing.T) {
+	broker := newTestBroker(t)
+	first, firstChanges := elect(t, broker)
+	if leader := receive(t, firstChanges); !leader {
+		t.Fatal("the first candidate didn't become leader")
+	}
+	second, secondChanges := elect(t, broker)
+
+	// Only the active consumer hears pings, the waiting candidate's included.
+	time.Sleep(5 * testElectionInterval)
+	if !first.IsLeader() || second.IsLeader() {
+		t.Errorf("first leads %v and second %v, want only the first", first.IsLeader(), second.IsLeader())
+	}
+
+	if err := first.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if leader := receive(t, firstChanges); leader {
+		t.Error("the closed candidate didn't step down")
+	}
+	if leader := receive(t, secondChanges); !leader {
+		t.Error("the waiting candidate didn't take over")
+	}
+	if first.IsLeader() {
+		t.Error("the closed candidate still leads")
+	}
+}
+
+func TestElectionStepsDownOnConnectionLoss(t *testing.T) {
+	broker := NewMemoryBroker()
+	election, changes := elect(t, newTestManaged(t, broker))
+	if leader := receive(t, changes); !leader {
+		t.Fatal("the only candidate didn't become leader")
+	}
+
+	broker.Restart()
+	if leader := receive(t, changes); leader {
+		t.Fatal("got a second leadership change to leader, want a step down when the connection dropped")
+	}
+
+	// Back on the restored queue, the candidate hears its own pings again.
+	if leader := receive(t, changes); !leader {
+		t.Error("the candidate didn't lead again after reconnecting")
+	}
+	if !election.IsLeader() {
+		t.Error("IsLeader is false after reconnecting")
+	}
+}
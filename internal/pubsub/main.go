@@ -1,13 +1,15 @@
 package pubsub
 
 import (
-	"bytes"
 	"context"
-	"encoding/gob"
-	"encoding/json"
+	"errors"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/codec"
 	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
 	amqp "github.com/rabbitmq/amqp091-go"
-	"log"
+	"log/slog"
+	"reflect"
+	"strconv"
+	"time"
 )
 
 const (
@@ -21,26 +23,85 @@ const (
 	Ack AckType = iota
 	NackRequeue
 	NackDiscard
+	RetryLater
 )
 
-func PublishJSON[T any](ch *amqp.Channel, exchange, key string, val T) error {
-	valBytes, err := json.Marshal(val)
+// Publish encodes val with the JSON codec unless WithCodec picks another, stamping the codec's
+// content type on the message so consumers know how to decode it. Every message also gets a fresh
+// message ID, a timestamp and the identity set with SetIdentity.
+func Publish[T any](ctx context.Context, ch Publisher, exchange, key string, val T, opts ...PublishOption) error {
+	options := newPublishOptions(opts)
+
+	body, err := options.codec.Marshal(val)
 	if err != nil {
 		return err
 	}
 
-	if err = ch.PublishWithContext(context.Background(), exchange, key, false, false, amqp.Publishing{
-		ContentType: "application/json",
-		Body:        valBytes,
-	}); err != nil {
-		return err
+	publishing := options.publishing(body)
+	span := startPublishSpan(ctx, "publish "+exchange, exchange, key, &publishing)
+	defer span.End()
+
+	err = ch.PublishWithContext(ctx, exchange, key, options.mandatory, false, publishing)
+	span.SetError(err)
+
+	return countPublished(exchange, 1, err)
+}
+
+// PublishBatch publishes every value to the same exchange and key, each with its own message ID
+// unless WithMessageID is given. On a PublisherPool or ConfirmedPublisher the batch goes out on one
+// channel without waiting for confirmations in between, and the error is the first failure among
+// them; on any other Publisher the values are published one by one.
+func PublishBatch[T any](ctx context.Context, ch Publisher, exchange, key string, vals []T, opts ...PublishOption) error {
+	messages := make([]outgoing, 0, len(vals))
+	for _, val := range vals {
+		options := newPublishOptions(opts)
+
+		body, err := options.codec.Marshal(val)
+		if err != nil {
+			return err
+		}
+		messages = append(messages, outgoing{exchange: exchange, key: key, mandatory: options.mandatory, publishing: options.publishing(body)})
 	}
 
-	return nil
+	publishings := make([]*amqp.Publishing, len(messages))
+	for i := range messages {
+		publishings[i] = &messages[i].publishing
+	}
+	span := startPublishSpan(ctx, "publish batch "+exchange, exchange, key, publishings...)
+	span.SetAttribute("messages", strconv.Itoa(len(messages)))
+	defer span.End()
+
+	if batch, ok := ch.(batchPublisher); ok {
+		err := batch.publishAll(ctx, messages)
+		span.SetError(err)
+		return countPublished(exchange, len(messages), err)
+	}
+
+	for i, m := range messages {
+		if err := ch.PublishWithContext(ctx, m.exchange, m.key, m.mandatory, false, m.publishing); err != nil {
+			span.SetError(err)
+			countPublished(exchange, i, nil)
+			return countPublished(exchange, len(messages)-i, err)
+		}
+	}
+
+	return countPublished(exchange, len(messages), nil)
+}
+
+type batchPublisher interface {
+	publishAll(ctx context.Context, messages []outgoing) error
 }
 
-func DeclareAndBind(conn *amqp.Connection, exchange, queueName, key string, simpleQueueType int) (*amqp.Channel, amqp.Queue, error) {
-	channel, err := conn.Channel()
+func PublishJSON[T any](ch Publisher, exchange, key string, val T) error {
+	return Publish(context.Background(), ch, exchange, key, val, WithCodec(codec.JSON))
+}
+
+func PublishGob[T any](ch Publisher, exchange, key string, val T) error {
+	return Publish(context.Background(), ch, exchange, key, val, WithCodec(codec.Gob))
+}
+
+func DeclareAndBind(broker Broker, exchange, queueName, key string, simpleQueueType int) (Channel, amqp.Queue, error) {
+	channel, err := broker.Channel()
 	if err != nil {
 		return nil, amqp.Queue{}, err
 	}
@@ -50,90 +111,219 @@ func DeclareAndBind(conn *amqp.Connection, exchange, queueName, key string, simp
 	queue, err := channel.QueueDeclare(queueName, durable, !durable, !durable, false, amqp.Table{
 		"x-dead-letter-exchange": routing.ExchangePerilDLX,
 	})
+	if err == nil {
+		err = channel.QueueBind(queueName, key, exchange, false, nil)
+	}
 	if err != nil {
+		closeChannel(channel)
 		return nil, amqp.Queue{}, err
 	}
 
-	err = channel.QueueBind(queueName, key, exchange, false, nil)
+	return channel, queue, nil
+}
+
+// closeChannel closes a channel that is no longer needed and stops it being redeclared.
+func closeChannel(channel Channel) error {
+	forgetDeclarations(channel)
+	return channel.Close()
+}
 
-	return channel, queue, err
+// Subscribe decodes each delivery with the codec registered for its content type, so producers can
+// switch codecs without consumers being redeployed. Deliveries without a content type fall back to
+// the WithDefaultCodec codec, JSON unless set; unknown content types are quarantined.
+func Subscribe[T any](ctx context.Context, broker Broker, exchange, queueName, key string, simpleQueueType int, handler func(T) AckType, opts ...SubscribeOption) (*Subscription, error) {
+	return SubscribeMessage(ctx, broker, exchange, queueName, key, simpleQueueType, func(message Message[T]) AckType {
+		return handler(message.Body)
+	}, opts...)
 }
 
-func SubscribeJSON[T any](conn *amqp.Connection, exchange, queueName, key string, simpleQueueType int, handler func(T) AckType) error {
-	return subscribe(conn, exchange, queueName, key, simpleQueueType, handler, func(i []byte) (T, error) {
+// SubscribeMessage is Subscribe for handlers that also need the delivery's metadata.
+func SubscribeMessage[T any](ctx context.Context, broker Broker, exchange, queueName, key string, simpleQueueType int, handler func(Message[T]) AckType, opts ...SubscribeOption) (*Subscription, error) {
+	options := newSubscribeOptions(opts)
+
+	return subscribe(ctx, broker, exchange, queueName, key, simpleQueueType, handler, options, func(delivery amqp.Delivery) (T, error) {
 		var target T
-		return target, json.Unmarshal(i, &target)
+
+		decoder := options.defaultCodec
+		if delivery.ContentType != "" {
+			var err error
+			if decoder, err = codec.Lookup(delivery.ContentType); err != nil {
+				return target, err
+			}
+		}
+
+		return target, decoder.Unmarshal(delivery.Body, &target)
 	})
 }
 
-func SubscribeGob[T any](conn *amqp.Connection, exchange, queueName, key string, simpleQueueType int, handler func(T) AckType) error {
-	return subscribe(conn, exchange, queueName, key, simpleQueueType, handler, func(i []byte) (T, error) {
-		source := bytes.NewBuffer(i)
-		decoder := gob.NewDecoder(source)
+func SubscribeJSON[T any](ctx context.Context, broker Broker, exchange, queueName, key string, simpleQueueType int, handler func(T) AckType, opts ...SubscribeOption) (*Subscription, error) {
+	return Subscribe(ctx, broker, exchange, queueName, key, simpleQueueType, handler, append([]SubscribeOption{WithDefaultCodec(codec.JSON)}, opts...)...)
+}
 
-		var result T
-		err := decoder.Decode(&result)
-		return result, err
-	})
+func SubscribeGob[T any](ctx context.Context, broker Broker, exchange, queueName, key string, simpleQueueType int, handler func(T) AckType, opts ...SubscribeOption) (*Subscription, error) {
+	return Subscribe(ctx, broker, exchange, queueName, key, simpleQueueType, handler, append([]SubscribeOption{WithDefaultCodec(codec.Gob)}, opts...)...)
 }
 
-func PublishGob[T any](ch *amqp.Channel, exchange, key string, val T) error {
-	var buffer bytes.Buffer
-	err := gob.NewEncoder(&buffer).Encode(val)
+func subscribe[T any](ctx context.Context, broker Broker, exchange, queueName, key string, simpleQueueType int, handler func(Message[T]) AckType, options subscribeOptions, unmarshaller func(amqp.Delivery) (T, error)) (*Subscription, error) {
+	channel, queue, err := DeclareAndBind(broker, exchange, queueName, key, simpleQueueType)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if err = ch.PublishWithContext(context.Background(), exchange, key, false, false, amqp.Publishing{
-		ContentType: "application/gob",
-		Body:        buffer.Bytes(),
-	}); err != nil {
-		return err
+	if err = channel.Qos(options.prefetch, 0, options.globalQos); err != nil {
+		closeChannel(channel)
+		return nil, err
 	}
 
-	return nil
-}
-
-func subscribe[T any](conn *amqp.Connection, exchange, queueName, key string, simpleQueueType int, handler func(T) AckType, unmarshaller func([]byte) (T, error)) error {
-	channel, queue, err := DeclareAndBind(conn, exchange, queueName, key, simpleQueueType)
+	consumerTag := newConsumerTag(queue.Name)
+	consume, err := channel.Consume(queue.Name, consumerTag, false, false, false, false, nil)
 	if err != nil {
-		return err
+		closeChannel(channel)
+		return nil, err
 	}
 
-	if err = channel.Qos(10, 10, true); err != nil {
-		return err
+	ctx, cancel := context.WithCancel(ctx)
+	subscription := &Subscription{
+		Queue:       queue.Name,
+		ConsumerTag: consumerTag,
+		cancel:      cancel,
+		done:        make(chan struct{}),
 	}
 
-	consume, err := channel.Consume(queue.Name, "", false, false, false, false, nil)
-	if err != nil {
-		return err
-	}
+	retries := newRetrier(channel, queue.Name, simpleQueueType == QueueTypeDurable, options.retryPolicy)
+	targetType := reflect.TypeOf((*T)(nil)).Elem().String()
+	middleware := append(globalMiddleware(), options.middleware...)
+	handle := func(delivery amqp.Delivery) (err error) {
+		deliveriesTotal.Inc(queue.Name)
 
-	go func() {
-		for delivery := range consume {
-			target, err := unmarshaller(delivery.Body)
+		ctx, span := startConsumeSpan(contextWithQueue(ctx, queue.Name), queue.Name, delivery)
+		defer func() {
+			span.SetError(err)
+			span.End()
+		}()
+
+		var dedupeKey string
+		if options.dedupe != nil && delivery.MessageId != "" {
+			// Scope keys by queue so one store can serve several subscriptions.
+			dedupeKey = queue.Name + " " + delivery.MessageId
+			seen, err := options.dedupe.Seen(dedupeKey)
 			if err != nil {
-				log.Fatal(err)
+				slog.ErrorContext(ctx, "Could not check for duplicates", deliveryAttrs(ctx, delivery, slog.Any("error", err))...)
 			}
+			if seen {
+				subscription.duplicates.Add(1)
+				duplicatesTotal.Inc(queue.Name)
+				span.SetAttribute("outcome", "duplicate")
+				slog.InfoContext(ctx, "Dropping duplicate message", deliveryAttrs(ctx, delivery)...)
+				return delivery.Ack(false)
+			}
+		}
 
-			ackType := handler(target)
-			switch ackType {
-			case NackRequeue:
-				log.Println("NackRequeue")
-				err = delivery.Nack(false, true)
-			case NackDiscard:
-				log.Println("NackDiscard")
-				err = delivery.Nack(false, false)
-			case Ack:
-				log.Println("Ack")
-				err = delivery.Ack(false)
+		target, err := unmarshaller(delivery)
+		if err != nil {
+			decodeErr := &DecodeError{Err: err, TargetType: targetType, Queue: queue.Name, Delivery: delivery}
+			slog.WarnContext(ctx, "Quarantining message", deliveryAttrs(ctx, delivery, slog.Any("error", decodeErr))...)
+			decodeFailuresTotal.Inc(queue.Name)
+			span.SetAttribute("outcome", "quarantined")
+			span.SetError(decodeErr)
+
+			err = quarantine(context.WithoutCancel(ctx), channel, decodeErr)
+			if options.onDecodeError != nil {
+				options.onDecodeError(decodeErr)
 			}
+			return err
+		}
 
-			if err != nil {
-				log.Fatal(err)
+		message := newMessage(target, delivery)
+		message.ctx = ctx
+		start := time.Now()
+		ackType := chain(func(context.Context, amqp.Delivery) AckType {
+			return handler(message)
+		}, middleware)(ctx, delivery)
+		handlerSeconds.Observe(time.Since(start).Seconds(), queue.Name)
+		span.SetAttribute("outcome", ackType.String())
+
+		switch ackType {
+		case NackRequeue:
+			requeuesTotal.Inc(queue.Name)
+			return delivery.Nack(false, true)
+		case NackDiscard:
+			discardsTotal.Inc(queue.Name)
+			return delivery.Nack(false, false)
+		case RetryLater:
+			retriesTotal.Inc(queue.Name)
+			return retries.retry(context.WithoutCancel(ctx), delivery)
+		default:
+			acksTotal.Inc(queue.Name)
+			if dedupeKey != "" {
+				if err := options.dedupe.Mark(dedupeKey); err != nil {
+					slog.ErrorContext(ctx, "Could not record message as processed", deliveryAttrs(ctx, delivery, slog.Any("error", err))...)
+				}
+			}
+			return delivery.Ack(false)
+		}
+	}
+
+	go func() {
+		defer close(subscription.done)
+		defer cancel()
+
+		workers := newWorkerPool(options.workers, options.prefetch, options.keyOrdering, func(delivery amqp.Delivery) error {
+			err := handle(delivery)
+			if errors.Is(err, amqp.ErrClosed) {
+				// The channel died before the delivery was settled, so the broker will redeliver it.
+				slog.WarnContext(ctx, "Could not settle message on a closed channel", deliveryAttrs(ctx, delivery)...)
+				return nil
+			}
+			return err
+		})
+		dispatch := func(delivery amqp.Delivery) {
+			delivery = trustRoute(delivery, queue.Name)
+			if options.throttle == nil || options.throttle.allow(contextWithQueue(ctx, queue.Name), delivery) {
+				workers.dispatch(delivery)
+				return
+			}
+
+			deliveriesTotal.Inc(queue.Name)
+			discardsTotal.Inc(queue.Name)
+			if err := delivery.Nack(false, false); err != nil && !errors.Is(err, amqp.ErrClosed) {
+				workers.fail(err)
 			}
 		}
+		subscription.err = consumeUntilDone(ctx, channel, consumerTag, consume, workers, dispatch)
+		if err := closeChannel(channel); err != nil && subscription.err == nil {
+			subscription.err = err
+		}
 	}()
 
-	return nil
+	return subscription, nil
+}
+
+// consumeUntilDone dispatches deliveries to the workers until ctx is cancelled or a handler fails.
+func consumeUntilDone(ctx context.Context, channel Channel, consumerTag string, deliveries <-chan amqp.Delivery, workers *workerPool, dispatch func(amqp.Delivery)) error {
+	for {
+		select {
+		case delivery, ok := <-deliveries:
+			if !ok {
+				if err := workers.stop(); err != nil {
+					return err
+				}
+				return ErrConsumerClosed
+			}
+			dispatch(delivery)
+		case <-workers.failed:
+			return workers.stop()
+		case <-ctx.Done():
+			if err := channel.Cancel(consumerTag, false); err != nil {
+				workers.stop()
+				return err
+			}
+
+			for delivery := range deliveries {
+				dispatch(delivery)
+			}
+
+			return workers.stop()
+		}
+	}
 }
@@ -0,0 +1,370 @@
+package pubsub
+
+import (
+	"context"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/codec"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testTimeout = 2 * time.Second
+
+type testMove struct {
+	Player string
+	Units  []int
+}
+
+func newTestBroker(t *testing.T) *MemoryBroker {
+	t.Helper()
+
+	broker := NewMemoryBroker()
+	if err := ApplyTopology(broker, routing.PerilTopology); err != nil {
+		t.Fatal(err)
+	}
+
+	return broker
+}
+
+func newTestChannel(t *testing.T, broker Broker) Channel {
+	t.Helper()
+
+	channel, err := broker.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { channel.Close() })
+
+	return channel
+}
+
+func receive[T any](t *testing.T, messages <-chan T) T {
+	t.Helper()
+
+	select {
+	case message := <-messages:
+		return message
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for a message")
+	}
+
+	var zero T
+	return zero
+}
+
+func eventually(t *testing.T, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(testTimeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// deadLetter takes the next message off the dead-letter queue.
+func deadLetter(t *testing.T, broker Broker) amqp.Delivery {
+	t.Helper()
+
+	channel := newTestChannel(t, broker)
+	var delivery amqp.Delivery
+	eventually(t, func() bool {
+		var ok bool
+		var err error
+		delivery, ok, err = channel.Get(routing.QueuePerilDLQ, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	})
+
+	return delivery
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	broker := newTestBroker(t)
+	received := make(chan Message[testMove], 1)
+
+	subscription, err := SubscribeMessage(context.Background(), broker, routing.ExchangePerilTopic, "test_moves", "test_moves.*", QueueTypeTransient, func(message Message[testMove]) AckType {
+		received <- message
+		return Ack
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscription.Close()
+
+	publisher := newTestChannel(t, broker)
+	want := testMove{Player: "washington", Units: []int{1, 2}}
+	if err := Publish(context.Background(), publisher, routing.ExchangePerilTopic, "test_moves.washington", want, WithCodec(codec.MsgPack), WithCorrelationID("cause")); err != nil {
+		t.Fatal(err)
+	}
+
+	message := receive(t, received)
+	if message.Body.Player != want.Player || len(message.Body.Units) != 2 || message.Body.Units[1] != 2 {
+		t.Errorf("got %+v, want %+v", message.Body, want)
+	}
+	if message.ContentType != codec.MsgPack.ContentType() {
+		t.Errorf("content type %q, want %q", message.ContentType, codec.MsgPack.ContentType())
+	}
+	if message.MessageID == "" {
+		t.Error("message has no ID")
+	}
+	if message.CorrelationID != "cause" {
+		t.Errorf("correlation ID %q, want %q", message.CorrelationID, "cause")
+	}
+	if message.RoutingKey != "test_moves.washington" {
+		t.Errorf("routing key %q, want %q", message.RoutingKey, "test_moves.washington")
+	}
+}
+
+func TestRetryLater(t *testing.T) {
+	broker := newTestBroker(t)
+	attempts := make(chan Message[testMove], 10)
+
+	subscription, err := SubscribeMessage(context.Background(), broker, routing.ExchangePerilTopic, "test_retries", "test_retries.*", QueueTypeDurable, func(message Message[testMove]) AckType {
+		attempts <- message
+		return RetryLater
+	}, WithRetryPolicy(RetryPolicy{Backoff: Backoff{Initial: 10 * time.Millisecond, Max: 20 * time.Millisecond}, MaxAttempts: 2}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscription.Close()
+
+	if err := Publish(context.Background(), newTestChannel(t, broker), routing.ExchangePerilTopic, "test_retries.washington", testMove{Player: "washington"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for want := 0; want <= 2; want++ {
+		message := receive(t, attempts)
+		if message.Attempt != want {
+			t.Errorf("attempt %d, want %d", message.Attempt, want)
+		}
+		if message.RoutingKey != "test_retries.washington" || message.Exchange != routing.ExchangePerilTopic {
+			t.Errorf("retried message lost its origin: exchange %q, key %q", message.Exchange, message.RoutingKey)
+		}
+	}
+
+	// Out of attempts, the message is dead-lettered.
+	letter := NewDeadLetter(deadLetter(t, broker))
+	if len(letter.Deaths) == 0 || letter.Deaths[0].Queue != "test_retries" {
+		t.Errorf("deaths %+v, want the last in test_retries", letter.Deaths)
+	}
+	if letter.OriginalRoutingKey != "test_retries.washington" {
+		t.Errorf("dead letter's original key %q, want test_retries.washington", letter.OriginalRoutingKey)
+	}
+	select {
+	case message := <-attempts:
+		t.Errorf("message retried past MaxAttempts: attempt %d", message.Attempt)
+	default:
+	}
+}
+
+// TestForgedRoute checks that a publisher can't pass a message off as sent under another routing key.
+func TestForgedRoute(t *testing.T) {
+	broker := newTestBroker(t)
+	messages := make(chan Message[testMove], 10)
+
+	subscription, err := SubscribeMessage(context.Background(), broker, routing.ExchangePerilTopic, "test_forged", "test_forged.*", QueueTypeDurable, func(message Message[testMove]) AckType {
+		messages <- message
+		if message.Attempt == 0 {
+			return RetryLater
+		}
+		return Ack
+	}, WithRetryPolicy(RetryPolicy{Backoff: Backoff{Initial: 10 * time.Millisecond, Max: 10 * time.Millisecond}, MaxAttempts: 1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscription.Close()
+
+	forged := amqp.Table{
+		HeaderOriginalExchange:   routing.ExchangePerilDirect,
+		HeaderOriginalRoutingKey: "test_forged.lincoln",
+	}
+	channel := newTestChannel(t, broker)
+	for _, route := range []struct{ exchange, key string }{
+		{routing.ExchangePerilTopic, "test_forged.washington"},
+		{"", "test_forged"},
+	} {
+		err := channel.PublishWithContext(context.Background(), route.exchange, route.key, false, false, amqp.Publishing{
+			ContentType: codec.JSON.ContentType(),
+			Headers:     forged,
+			Body:        []byte(`{"Player":"washington"}`),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The first delivery and its retry both carry the route it was really published with.
+		for range 2 {
+			message := receive(t, messages)
+			if message.Exchange != route.exchange || message.RoutingKey != route.key {
+				t.Errorf("attempt %d: got exchange %q, key %q, want %q, %q", message.Attempt, message.Exchange, message.RoutingKey, route.exchange, route.key)
+			}
+		}
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	broker := newTestBroker(t)
+	decodeErrors := make(chan *DecodeError, 1)
+
+	subscription, err := Subscribe(context.Background(), broker, routing.ExchangePerilTopic, "test_poison", "test_poison.*", QueueTypeDurable, func(testMove) AckType {
+		t.Error("handler called for an undecodable message")
+		return Ack
+	}, OnDecodeError(func(decodeErr *DecodeError) {
+		decodeErrors <- decodeErr
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscription.Close()
+
+	err = newTestChannel(t, broker).PublishWithContext(context.Background(), routing.ExchangePerilTopic, "test_poison.washington", false, false, amqp.Publishing{
+		ContentType: codec.JSON.ContentType(),
+		MessageId:   "poison",
+		Body:        []byte("{not json"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decodeErr := receive(t, decodeErrors)
+	if decodeErr.Queue != "test_poison" {
+		t.Errorf("decode error for queue %q, want test_poison", decodeErr.Queue)
+	}
+
+	delivery := deadLetter(t, broker)
+	if string(delivery.Body) != "{not json" || delivery.MessageId != "poison" {
+		t.Errorf("quarantined %q (ID %q), want the original message", delivery.Body, delivery.MessageId)
+	}
+	letter := NewDeadLetter(delivery)
+	if letter.DecodeError == "" {
+		t.Error("quarantined message doesn't say why it couldn't be decoded")
+	}
+	if letter.OriginalExchange != routing.ExchangePerilTopic || letter.OriginalRoutingKey != "test_poison.washington" {
+		t.Errorf("quarantined from %q with key %q, want the original route", letter.OriginalExchange, letter.OriginalRoutingKey)
+	}
+}
+
+func TestCloseDrains(t *testing.T) {
+	broker := newTestBroker(t)
+	started := make(chan struct{}, 10)
+	release := make(chan struct{})
+	var handled atomic.Int32
+
+	subscription, err := Subscribe(context.Background(), broker, routing.ExchangePerilTopic, "test_drain", "test_drain.*", QueueTypeDurable, func(testMove) AckType {
+		started <- struct{}{}
+		<-release
+		handled.Add(1)
+		return Ack
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publisher := newTestChannel(t, broker)
+	for range 3 {
+		if err := Publish(context.Background(), publisher, routing.ExchangePerilTopic, "test_drain.washington", testMove{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	receive(t, started)
+
+	closed := make(chan error, 1)
+	go func() { closed <- subscription.Close() }()
+	select {
+	case err := <-closed:
+		t.Fatalf("Close returned before the handler finished: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if err := receive(t, closed); err != nil {
+		t.Fatal(err)
+	}
+	// Whatever the consumer had received is handled and acked; the rest goes back on the queue.
+	queue, err := newTestChannel(t, broker).QueueDeclarePassive("test_drain", true, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := int(handled.Load()); n == 0 || n+queue.Messages != 3 {
+		t.Errorf("handled %d messages and left %d on the queue, want the 3 accounted for", n, queue.Messages)
+	}
+}
+
+func TestDedupe(t *testing.T) {
+	broker := newTestBroker(t)
+	received := make(chan testMove, 10)
+
+	subscription, err := Subscribe(context.Background(), broker, routing.ExchangePerilTopic, "test_dedupe", "test_dedupe.*", QueueTypeDurable, func(move testMove) AckType {
+		received <- move
+		return Ack
+	}, WithDedupe(NewMemoryDedupeStore(10, time.Hour)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscription.Close()
+
+	publisher := newTestChannel(t, broker)
+	for _, player := range []string{"first", "again"} {
+		if err := Publish(context.Background(), publisher, routing.ExchangePerilTopic, "test_dedupe.washington", testMove{Player: player}, WithMessageID("same")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := Publish(context.Background(), publisher, routing.ExchangePerilTopic, "test_dedupe.washington", testMove{Player: "other"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if move := receive(t, received); move.Player != "first" {
+		t.Errorf("got %q, want the first copy", move.Player)
+	}
+	if move := receive(t, received); move.Player != "other" {
+		t.Errorf("got %q, want the message with another ID", move.Player)
+	}
+	eventually(t, func() bool { return subscription.Duplicates() == 1 })
+}
+
+func TestWorkersKeepKeyOrder(t *testing.T) {
+	broker := newTestBroker(t)
+
+	var mu sync.Mutex
+	seen := map[string][]int{}
+	var handled atomic.Int32
+	subscription, err := SubscribeMessage(context.Background(), broker, routing.ExchangePerilTopic, "test_order", "test_order.*", QueueTypeDurable, func(message Message[testMove]) AckType {
+		mu.Lock()
+		seen[message.RoutingKey] = append(seen[message.RoutingKey], message.Body.Units[0])
+		mu.Unlock()
+		handled.Add(1)
+		return Ack
+	}, WithWorkers(4), WithKeyOrdering())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscription.Close()
+
+	publisher := newTestChannel(t, broker)
+	keys := []string{"test_order.a", "test_order.b", "test_order.c"}
+	for i := range 30 {
+		if err := Publish(context.Background(), publisher, routing.ExchangePerilTopic, keys[i%len(keys)], testMove{Units: []int{i}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	eventually(t, func() bool { return handled.Load() == 30 })
+
+	mu.Lock()
+	defer mu.Unlock()
+	for key, units := range seen {
+		for i := 1; i < len(units); i++ {
+			if units[i] < units[i-1] {
+				t.Errorf("%s handled out of order: %v", key, units)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,1322 @@
+package pubsub
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	headerDeadLetterExchange   = "x-dead-letter-exchange"
+	headerDeadLetterRoutingKey = "x-dead-letter-routing-key"
+	headerExpires              = "x-expires"
+	headerMessageTTL           = "x-message-ttl"
+	headerSingleActiveConsumer = "x-single-active-consumer"
+)
+
+// MemoryBroker is an in-process stand-in for RabbitMQ. It implements direct, topic, fanout and
+// consistent-hash exchanges, exchange-to-exchange bindings, exclusive, auto-delete and
+// single-active-consumer queues, prefetch, ack/nack/requeue, message TTLs, queue expiry,
+// dead-lettering and direct reply-to.
+type MemoryBroker struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	exchanges map[string]*memoryExchange
+	queues    map[string]*memoryQueue
+	nextID    int
+	conn      *MemoryConnection
+	conns     map[*MemoryConnection]struct{}
+}
+
+type memoryExchange struct {
+	name       string
+	kind       string
+	durable    bool
+	autoDelete bool
+	bindings   []memoryBinding
+}
+
+// memoryBinding leads to either a queue or, for exchange-to-exchange bindings, an exchange.
+type memoryBinding struct {
+	queue    string
+	exchange string
+	key      string
+}
+
+type memoryQueue struct {
+	name       string
+	durable    bool
+	autoDelete bool
+	exclusive  bool
+	owner      *MemoryConnection
+	args       amqp.Table
+	messages   []memoryMessage
+	consumers  map[*memoryConsumer]struct{}
+	// waiting holds a single-active-consumer queue's consumers, oldest first.
+	waiting []*memoryConsumer
+	// uses counts what restarts an x-expires countdown: declares, gets and the last consumer leaving.
+	uses    int
+	deleted bool
+}
+
+type memoryMessage struct {
+	exchange    string
+	key         string
+	publishing  amqp.Publishing
+	redelivered bool
+	expiresAt   time.Time
+}
+
+type MemoryConnection struct {
+	broker   *MemoryBroker
+	channels map[*memoryChannel]struct{}
+	closes   []chan *amqp.Error
+	closed   bool
+}
+
+type memoryChannel struct {
+	conn      *MemoryConnection
+	prefetch  int
+	global    bool
+	nextTag   uint64
+	unacked   map[uint64]*memoryUnacked
+	consumers map[string]*memoryConsumer
+	replyTo   *memoryQueue
+	closed    bool
+
+	confirm       bool
+	published     uint64
+	confirms      []chan amqp.Confirmation
+	returns       []chan amqp.Return
+	closes        []chan *amqp.Error
+	notifications []func()
+	notifying     bool
+}
+
+type memoryUnacked struct {
+	queue    *memoryQueue
+	message  memoryMessage
+	consumer *memoryConsumer
+}
+
+type memoryConsumer struct {
+	tag     string
+	queue   *memoryQueue
+	channel *memoryChannel
+	autoAck bool
+	unacked int
+	out     chan amqp.Delivery
+	done    chan struct{}
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	broker := &MemoryBroker{
+		exchanges: map[string]*memoryExchange{},
+		queues:    map[string]*memoryQueue{},
+		conns:     map[*MemoryConnection]struct{}{},
+	}
+	broker.cond = sync.NewCond(&broker.mu)
+
+	for name, kind := range map[string]string{
+		"":           amqp.ExchangeDirect,
+		"amq.direct": amqp.ExchangeDirect,
+		"amq.topic":  amqp.ExchangeTopic,
+		"amq.fanout": amqp.ExchangeFanout,
+	} {
+		broker.exchanges[name] = &memoryExchange{name: name, kind: kind, durable: true}
+	}
+
+	return broker
+}
+
+// Connect opens a new connection; exclusive queues belong to the connection that declared them.
+func (b *MemoryBroker) Connect() *MemoryConnection {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.connectLocked()
+}
+
+func (b *MemoryBroker) connectLocked() *MemoryConnection {
+	conn := &MemoryConnection{broker: b, channels: map[*memoryChannel]struct{}{}}
+	b.conns[conn] = struct{}{}
+	return conn
+}
+
+// Restart simulates the broker restarting. Every connection is closed with CONNECTION_FORCED, and
+// only durable exchanges, durable queues and the persistent messages on them survive.
+func (b *MemoryBroker) Restart() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for conn := range b.conns {
+		conn.closeLocked(&amqp.Error{
+			Code:   amqp.ConnectionForced,
+			Reason: "CONNECTION_FORCED - broker forced connection closure with reason 'shutdown'",
+			Server: true,
+		})
+	}
+	b.conn = nil
+
+	for _, queue := range b.queues {
+		if !queue.durable {
+			b.deleteQueueLocked(queue)
+			continue
+		}
+
+		persistent := queue.messages[:0]
+		for _, msg := range queue.messages {
+			if msg.publishing.DeliveryMode == amqp.Persistent {
+				persistent = append(persistent, msg)
+			}
+		}
+		queue.messages = persistent
+	}
+
+	for name, ex := range b.exchanges {
+		if !ex.durable {
+			delete(b.exchanges, name)
+		}
+	}
+	for _, ex := range b.exchanges {
+		bindings := ex.bindings[:0]
+		for _, binding := range ex.bindings {
+			if _, ok := b.exchanges[binding.exchange]; binding.exchange == "" || ok {
+				bindings = append(bindings, binding)
+			}
+		}
+		ex.bindings = bindings
+	}
+
+	b.cond.Broadcast()
+}
+
+// Channel opens a channel on a shared default connection, so the broker itself can be used as a Broker.
+func (b *MemoryBroker) Channel() (Channel, error) {
+	b.mu.Lock()
+	if b.conn == nil {
+		b.conn = b.connectLocked()
+	}
+	conn := b.conn
+	b.mu.Unlock()
+
+	return conn.Channel()
+}
+
+func (c *MemoryConnection) Channel() (Channel, error) {
+	return c.channel()
+}
+
+func (c *MemoryConnection) channel() (liveChannel, error) {
+	b := c.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if c.closed {
+		return nil, amqp.ErrClosed
+	}
+
+	channel := &memoryChannel{
+		conn:      c,
+		unacked:   map[uint64]*memoryUnacked{},
+		consumers: map[string]*memoryConsumer{},
+	}
+	c.channels[channel] = struct{}{}
+
+	return channel, nil
+}
+
+func (c *MemoryConnection) Close() error {
+	b := c.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if c.closed {
+		return amqp.ErrClosed
+	}
+
+	c.closeLocked(nil)
+	b.cond.Broadcast()
+	return nil
+}
+
+// closeLocked closes the connection, reporting err to NotifyClose listeners unless the client
+// closed it.
+func (c *MemoryConnection) closeLocked(err *amqp.Error) {
+	b := c.broker
+	if c.closed {
+		return
+	}
+	c.closed = true
+	delete(b.conns, c)
+
+	for channel := range c.channels {
+		channel.closeLocked(err)
+	}
+
+	for _, queue := range b.queues {
+		if queue.exclusive && queue.owner == c {
+			b.deleteQueueLocked(queue)
+		}
+	}
+
+	for _, listener := range c.closes {
+		go func() {
+			if err != nil {
+				listener <- err
+			}
+			close(listener)
+		}()
+	}
+}
+
+func (c *MemoryConnection) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	c.broker.mu.Lock()
+	defer c.broker.mu.Unlock()
+
+	if c.closed {
+		close(receiver)
+		return receiver
+	}
+
+	c.closes = append(c.closes, receiver)
+	return receiver
+}
+
+func (c *MemoryConnection) IsClosed() bool {
+	c.broker.mu.Lock()
+	defer c.broker.mu.Unlock()
+	return c.closed
+}
+
+func (ch *memoryChannel) broker() *MemoryBroker {
+	return ch.conn.broker
+}
+
+func (ch *memoryChannel) Close() error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+
+	ch.closeLocked(nil)
+	b.cond.Broadcast()
+	return nil
+}
+
+func (ch *memoryChannel) IsClosed() bool {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return ch.closed
+}
+
+func (ch *memoryChannel) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		close(receiver)
+		return receiver
+	}
+
+	ch.closes = append(ch.closes, receiver)
+	return receiver
+}
+
+// closeLocked closes the channel, reporting err to NotifyClose listeners unless the client closed it.
+func (ch *memoryChannel) closeLocked(err *amqp.Error) {
+	if ch.closed {
+		return
+	}
+	ch.closed = true
+
+	for _, consumer := range ch.consumers {
+		ch.cancelLocked(consumer)
+	}
+
+	for tag := range ch.unacked {
+		ch.settleLocked(tag, true, true)
+	}
+
+	delete(ch.conn.channels, ch)
+
+	confirms, returns, closes := ch.confirms, ch.returns, ch.closes
+	ch.notifyLocked(func() {
+		for _, c := range confirms {
+			close(c)
+		}
+		for _, r := range returns {
+			close(r)
+		}
+		for _, c := range closes {
+			if err != nil {
+				c <- err
+			}
+			close(c)
+		}
+	})
+}
+
+// notifyLocked delivers notifications in order on another goroutine.
+func (ch *memoryChannel) notifyLocked(notification func()) {
+	ch.notifications = append(ch.notifications, notification)
+	if ch.notifying {
+		return
+	}
+
+	ch.notifying = true
+	go ch.drainNotifications()
+}
+
+func (ch *memoryChannel) drainNotifications() {
+	b := ch.broker()
+	for {
+		b.mu.Lock()
+		if len(ch.notifications) == 0 {
+			ch.notifying = false
+			b.mu.Unlock()
+			return
+		}
+		notification := ch.notifications[0]
+		ch.notifications = ch.notifications[1:]
+		b.mu.Unlock()
+
+		notification()
+	}
+}
+
+// fail mimics a channel-level exception: the broker closes the channel and reports the error.
+func (ch *memoryChannel) fail(code int, format string, args ...any) error {
+	err := &amqp.Error{Code: code, Reason: fmt.Sprintf(format, args...), Server: true}
+	ch.closeLocked(err)
+	ch.broker().cond.Broadcast()
+	return err
+}
+
+func (ch *memoryChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+
+	switch kind {
+	case amqp.ExchangeDirect, amqp.ExchangeTopic, amqp.ExchangeFanout, routing.ExchangeKindConsistentHash:
+	default:
+		return ch.fail(amqp.CommandInvalid, "COMMAND_INVALID - unknown exchange type '%s'", kind)
+	}
+
+	if existing, ok := b.exchanges[name]; ok {
+		if existing.kind != kind || existing.durable != durable || existing.autoDelete != autoDelete {
+			return ch.fail(amqp.PreconditionFailed, "PRECONDITION_FAILED - inequivalent arg for exchange '%s'", name)
+		}
+		return nil
+	}
+
+	b.exchanges[name] = &memoryExchange{name: name, kind: kind, durable: durable, autoDelete: autoDelete}
+	return nil
+}
+
+func (ch *memoryChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.Queue{}, amqp.ErrClosed
+	}
+
+	if name == "" {
+		b.nextID++
+		name = fmt.Sprintf("amq.gen-%d", b.nextID)
+	}
+
+	if existing, ok := b.queues[name]; ok {
+		if existing.exclusive && existing.owner != ch.conn {
+			return amqp.Queue{}, ch.fail(amqp.ResourceLocked, "RESOURCE_LOCKED - cannot obtain exclusive access to locked queue '%s'", name)
+		}
+		if existing.durable != durable || existing.autoDelete != autoDelete || existing.exclusive != exclusive || !equivalentArgs(existing.args, args) {
+			return amqp.Queue{}, ch.fail(amqp.PreconditionFailed, "PRECONDITION_FAILED - inequivalent arg for queue '%s'", name)
+		}
+		b.touchLocked(existing)
+		return amqp.Queue{Name: name, Messages: len(existing.messages), Consumers: len(existing.consumers)}, nil
+	}
+
+	queue := &memoryQueue{
+		name:       name,
+		durable:    durable,
+		autoDelete: autoDelete,
+		exclusive:  exclusive,
+		args:       args,
+		consumers:  map[*memoryConsumer]struct{}{},
+	}
+	if exclusive {
+		queue.owner = ch.conn
+	}
+	b.queues[name] = queue
+	b.touchLocked(queue)
+
+	return amqp.Queue{Name: name}, nil
+}
+
+func (ch *memoryChannel) ExchangeDeclarePassive(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+
+	if _, ok := b.exchanges[name]; !ok {
+		return ch.fail(amqp.NotFound, "NOT_FOUND - no exchange '%s'", name)
+	}
+
+	return nil
+}
+
+func (ch *memoryChannel) QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.Queue{}, amqp.ErrClosed
+	}
+
+	existing, ok := b.queues[name]
+	if !ok {
+		return amqp.Queue{}, ch.fail(amqp.NotFound, "NOT_FOUND - no queue '%s'", name)
+	}
+	if existing.exclusive && existing.owner != ch.conn {
+		return amqp.Queue{}, ch.fail(amqp.ResourceLocked, "RESOURCE_LOCKED - cannot obtain exclusive access to locked queue '%s'", name)
+	}
+
+	return amqp.Queue{Name: name, Messages: len(existing.messages), Consumers: len(existing.consumers)}, nil
+}
+
+func (ch *memoryChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+
+	if _, ok := b.queues[name]; !ok {
+		return ch.fail(amqp.NotFound, "NOT_FOUND - no queue '%s'", name)
+	}
+
+	ex, ok := b.exchanges[exchange]
+	if !ok || exchange == "" {
+		return ch.fail(amqp.NotFound, "NOT_FOUND - no exchange '%s'", exchange)
+	}
+
+	for _, binding := range ex.bindings {
+		if binding.queue == name && binding.key == key {
+			return nil
+		}
+	}
+	ex.bindings = append(ex.bindings, memoryBinding{queue: name, key: key})
+
+	return nil
+}
+
+func (ch *memoryChannel) QueueUnbind(name, key, exchange string, args amqp.Table) error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+
+	ex, ok := b.exchanges[exchange]
+	if !ok || exchange == "" {
+		return ch.fail(amqp.NotFound, "NOT_FOUND - no exchange '%s'", exchange)
+	}
+
+	for i, binding := range ex.bindings {
+		if binding.queue == name && binding.key == key {
+			ex.bindings = append(ex.bindings[:i], ex.bindings[i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
+
+func (ch *memoryChannel) ExchangeBind(destination, key, source string, noWait bool, args amqp.Table) error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+
+	for _, name := range []string{destination, source} {
+		if _, ok := b.exchanges[name]; !ok || name == "" {
+			return ch.fail(amqp.NotFound, "NOT_FOUND - no exchange '%s'", name)
+		}
+	}
+
+	ex := b.exchanges[source]
+	for _, binding := range ex.bindings {
+		if binding.exchange == destination && binding.key == key {
+			return nil
+		}
+	}
+	ex.bindings = append(ex.bindings, memoryBinding{exchange: destination, key: key})
+
+	return nil
+}
+
+func (ch *memoryChannel) PublishWithContext(_ context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+
+	if _, ok := b.exchanges[exchange]; !ok {
+		return ch.fail(amqp.NotFound, "NOT_FOUND - no exchange '%s'", exchange)
+	}
+
+	if msg.ReplyTo == directReplyTo {
+		if ch.replyTo == nil || ch.replyTo.deleted {
+			return ch.fail(amqp.PreconditionFailed, "PRECONDITION_FAILED - fast reply consumer does not exist")
+		}
+		msg.ReplyTo = ch.replyTo.name
+	}
+
+	msg.Body = append([]byte(nil), msg.Body...)
+	routed := b.routeLocked(exchange, key, memoryMessage{exchange: exchange, key: key, publishing: msg})
+	b.cond.Broadcast()
+
+	if mandatory && !routed {
+		returned := returnOf(exchange, key, msg)
+		returns := ch.returns
+		ch.notifyLocked(func() {
+			for _, r := range returns {
+				r <- returned
+			}
+		})
+	}
+
+	if ch.confirm {
+		ch.published++
+		confirmation := amqp.Confirmation{DeliveryTag: ch.published, Ack: true}
+		confirms := ch.confirms
+		ch.notifyLocked(func() {
+			for _, c := range confirms {
+				c <- confirmation
+			}
+		})
+	}
+
+	return nil
+}
+
+func (ch *memoryChannel) Confirm(noWait bool) error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+
+	ch.confirm = true
+	return nil
+}
+
+func (ch *memoryChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		close(confirm)
+		return confirm
+	}
+
+	ch.confirms = append(ch.confirms, confirm)
+	return confirm
+}
+
+func (ch *memoryChannel) NotifyReturn(returns chan amqp.Return) chan amqp.Return {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		close(returns)
+		return returns
+	}
+
+	ch.returns = append(ch.returns, returns)
+	return returns
+}
+
+func returnOf(exchange, key string, p amqp.Publishing) amqp.Return {
+	return amqp.Return{
+		ReplyCode:       amqp.NoRoute,
+		ReplyText:       "NO_ROUTE",
+		Exchange:        exchange,
+		RoutingKey:      key,
+		ContentType:     p.ContentType,
+		ContentEncoding: p.ContentEncoding,
+		Headers:         p.Headers,
+		DeliveryMode:    p.DeliveryMode,
+		Priority:        p.Priority,
+		CorrelationId:   p.CorrelationId,
+		ReplyTo:         p.ReplyTo,
+		Expiration:      p.Expiration,
+		MessageId:       p.MessageId,
+		Timestamp:       p.Timestamp,
+		Type:            p.Type,
+		UserId:          p.UserId,
+		AppId:           p.AppId,
+		Body:            p.Body,
+	}
+}
+
+func (ch *memoryChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+
+	ch.prefetch = prefetchCount
+	ch.global = global
+	b.cond.Broadcast()
+
+	return nil
+}
+
+func (ch *memoryChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return nil, amqp.ErrClosed
+	}
+
+	if queue == directReplyTo {
+		if !autoAck {
+			return nil, ch.fail(amqp.PreconditionFailed, "PRECONDITION_FAILED - reply consumer cannot acknowledge")
+		}
+		if ch.replyTo != nil && !ch.replyTo.deleted {
+			return nil, ch.fail(amqp.PreconditionFailed, "PRECONDITION_FAILED - reply consumer already set")
+		}
+
+		// A private queue stands in for the pseudo-queue.
+		b.nextID++
+		ch.replyTo = &memoryQueue{
+			name:       fmt.Sprintf("%s.%d", directReplyTo, b.nextID),
+			autoDelete: true,
+			exclusive:  true,
+			owner:      ch.conn,
+			consumers:  map[*memoryConsumer]struct{}{},
+		}
+		b.queues[ch.replyTo.name] = ch.replyTo
+		queue = ch.replyTo.name
+	}
+
+	q, ok := b.queues[queue]
+	if !ok {
+		return nil, ch.fail(amqp.NotFound, "NOT_FOUND - no queue '%s'", queue)
+	}
+	if q.exclusive && q.owner != ch.conn {
+		return nil, ch.fail(amqp.ResourceLocked, "RESOURCE_LOCKED - cannot obtain exclusive access to locked queue '%s'", queue)
+	}
+
+	if consumer == "" {
+		b.nextID++
+		consumer = fmt.Sprintf("amq.ctag-%d", b.nextID)
+	}
+	if _, ok := ch.consumers[consumer]; ok {
+		return nil, ch.fail(amqp.NotAllowed, "NOT_ALLOWED - attempt to reuse consumer tag '%s'", consumer)
+	}
+
+	c := &memoryConsumer{
+		tag:     consumer,
+		queue:   q,
+		channel: ch,
+		autoAck: autoAck,
+		out:     make(chan amqp.Delivery),
+		done:    make(chan struct{}),
+	}
+	ch.consumers[consumer] = c
+	q.consumers[c] = struct{}{}
+	if q.singleActive() {
+		q.waiting = append(q.waiting, c)
+	}
+
+	go b.deliver(c)
+
+	return c.out, nil
+}
+
+func (ch *memoryChannel) Cancel(consumer string, noWait bool) error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+
+	if c, ok := ch.consumers[consumer]; ok {
+		ch.cancelLocked(c)
+	}
+
+	return nil
+}
+
+func (ch *memoryChannel) cancelLocked(c *memoryConsumer) {
+	if _, ok := ch.consumers[c.tag]; !ok {
+		return
+	}
+
+	delete(ch.consumers, c.tag)
+	delete(c.queue.consumers, c)
+	for i, waiting := range c.queue.waiting {
+		if waiting == c {
+			c.queue.waiting = append(c.queue.waiting[:i], c.queue.waiting[i+1:]...)
+			break
+		}
+	}
+	close(c.done)
+	ch.broker().cond.Broadcast()
+
+	if len(c.queue.consumers) > 0 {
+		return
+	}
+	if c.queue.autoDelete {
+		ch.broker().deleteQueueLocked(c.queue)
+		return
+	}
+	ch.broker().touchLocked(c.queue)
+}
+
+func (ch *memoryChannel) Get(queue string, autoAck bool) (amqp.Delivery, bool, error) {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.Delivery{}, false, amqp.ErrClosed
+	}
+
+	q, ok := b.queues[queue]
+	if !ok {
+		return amqp.Delivery{}, false, ch.fail(amqp.NotFound, "NOT_FOUND - no queue '%s'", queue)
+	}
+	if q.exclusive && q.owner != ch.conn {
+		return amqp.Delivery{}, false, ch.fail(amqp.ResourceLocked, "RESOURCE_LOCKED - cannot obtain exclusive access to locked queue '%s'", queue)
+	}
+	b.touchLocked(q)
+	if len(q.messages) == 0 {
+		return amqp.Delivery{}, false, nil
+	}
+
+	msg := q.messages[0]
+	q.messages = q.messages[1:]
+
+	ch.nextTag++
+	if !autoAck {
+		ch.unacked[ch.nextTag] = &memoryUnacked{queue: q, message: msg}
+	}
+
+	delivery := msg.delivery(ch, "", ch.nextTag)
+	delivery.MessageCount = uint32(len(q.messages))
+	return delivery, true, nil
+}
+
+func (ch *memoryChannel) QueuePurge(name string, noWait bool) (int, error) {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return 0, amqp.ErrClosed
+	}
+
+	q, ok := b.queues[name]
+	if !ok {
+		return 0, ch.fail(amqp.NotFound, "NOT_FOUND - no queue '%s'", name)
+	}
+	if q.exclusive && q.owner != ch.conn {
+		return 0, ch.fail(amqp.ResourceLocked, "RESOURCE_LOCKED - cannot obtain exclusive access to locked queue '%s'", name)
+	}
+
+	purged := len(q.messages)
+	q.messages = nil
+	return purged, nil
+}
+
+func (ch *memoryChannel) Ack(tag uint64, multiple bool) error {
+	return ch.settle(tag, multiple, func(tag uint64) { ch.settleLocked(tag, false, false) })
+}
+
+func (ch *memoryChannel) Nack(tag uint64, multiple, requeue bool) error {
+	return ch.settle(tag, multiple, func(tag uint64) { ch.settleLocked(tag, true, requeue) })
+}
+
+func (ch *memoryChannel) Reject(tag uint64, requeue bool) error {
+	return ch.Nack(tag, false, requeue)
+}
+
+func (ch *memoryChannel) settle(tag uint64, multiple bool, settle func(uint64)) error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+
+	if _, ok := ch.unacked[tag]; !ok {
+		return ch.fail(amqp.PreconditionFailed, "PRECONDITION_FAILED - unknown delivery tag %d", tag)
+	}
+
+	if multiple {
+		for pending := range ch.unacked {
+			if pending < tag {
+				settle(pending)
+			}
+		}
+	}
+	settle(tag)
+	b.cond.Broadcast()
+
+	return nil
+}
+
+func (ch *memoryChannel) settleLocked(tag uint64, nack, requeue bool) {
+	pending, ok := ch.unacked[tag]
+	if !ok {
+		return
+	}
+
+	delete(ch.unacked, tag)
+	if pending.consumer != nil {
+		pending.consumer.unacked--
+	}
+
+	if !nack {
+		return
+	}
+
+	if requeue {
+		pending.queue.requeueLocked(pending.message)
+		return
+	}
+
+	ch.broker().deadLetterLocked(pending.queue, pending.message, "rejected")
+}
+
+func (q *memoryQueue) requeueLocked(msg memoryMessage) {
+	if q.deleted {
+		return
+	}
+
+	msg.redelivered = true
+	q.messages = append([]memoryMessage{msg}, q.messages...)
+}
+
+// deliver feeds one consumer until it is cancelled, honoring the channel's prefetch limit.
+func (b *MemoryBroker) deliver(c *memoryConsumer) {
+	defer close(c.out)
+
+	for {
+		b.mu.Lock()
+		for !c.isDone() && (len(c.queue.messages) == 0 || c.saturated() || !c.isActive()) {
+			b.cond.Wait()
+		}
+		if c.isDone() {
+			b.mu.Unlock()
+			return
+		}
+
+		msg := c.queue.messages[0]
+		c.queue.messages = c.queue.messages[1:]
+
+		ch := c.channel
+		ch.nextTag++
+		tag := ch.nextTag
+		if !c.autoAck {
+			ch.unacked[tag] = &memoryUnacked{queue: c.queue, message: msg, consumer: c}
+			c.unacked++
+		}
+		b.mu.Unlock()
+
+		select {
+		case c.out <- msg.delivery(ch, c.tag, tag):
+		case <-c.done:
+			b.mu.Lock()
+			if _, ok := ch.unacked[tag]; ok || c.autoAck {
+				delete(ch.unacked, tag)
+				c.queue.requeueLocked(msg)
+				b.cond.Broadcast()
+			}
+			b.mu.Unlock()
+			return
+		}
+	}
+}
+
+func (c *memoryConsumer) isDone() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *memoryConsumer) isActive() bool {
+	return !c.queue.singleActive() || (len(c.queue.waiting) > 0 && c.queue.waiting[0] == c)
+}
+
+func (q *memoryQueue) singleActive() bool {
+	active, _ := q.args[headerSingleActiveConsumer].(bool)
+	return active
+}
+
+func (c *memoryConsumer) saturated() bool {
+	ch := c.channel
+	if ch.prefetch <= 0 || c.autoAck {
+		return false
+	}
+
+	if ch.global {
+		return len(ch.unacked) >= ch.prefetch
+	}
+
+	return c.unacked >= ch.prefetch
+}
+
+func (m memoryMessage) delivery(ch *memoryChannel, consumerTag string, tag uint64) amqp.Delivery {
+	p := m.publishing
+	return amqp.Delivery{
+		Acknowledger:    ch,
+		Headers:         p.Headers,
+		ContentType:     p.ContentType,
+		ContentEncoding: p.ContentEncoding,
+		DeliveryMode:    p.DeliveryMode,
+		Priority:        p.Priority,
+		CorrelationId:   p.CorrelationId,
+		ReplyTo:         p.ReplyTo,
+		Expiration:      p.Expiration,
+		MessageId:       p.MessageId,
+		Timestamp:       p.Timestamp,
+		Type:            p.Type,
+		UserId:          p.UserId,
+		AppId:           p.AppId,
+		ConsumerTag:     consumerTag,
+		DeliveryTag:     tag,
+		Redelivered:     m.redelivered,
+		Exchange:        m.exchange,
+		RoutingKey:      m.key,
+		Body:            p.Body,
+	}
+}
+
+func (b *MemoryBroker) routeLocked(exchange, key string, msg memoryMessage) bool {
+	if exchange == "" {
+		queue, ok := b.queues[key]
+		if !ok {
+			return false
+		}
+		b.enqueueLocked(queue, msg)
+		return true
+	}
+
+	matched := map[string]struct{}{}
+	b.routeExchangeLocked(exchange, key, msg, matched, map[string]bool{})
+
+	return len(matched) > 0
+}
+
+// routeExchangeLocked enqueues msg once on every queue the exchange reaches.
+func (b *MemoryBroker) routeExchangeLocked(exchange, key string, msg memoryMessage, matched map[string]struct{}, visited map[string]bool) {
+	ex, ok := b.exchanges[exchange]
+	if !ok || visited[exchange] {
+		return
+	}
+	visited[exchange] = true
+
+	bindings := ex.bindings
+	if ex.kind == routing.ExchangeKindConsistentHash {
+		bindings = consistentHash(bindings, key)
+	}
+
+	for _, binding := range bindings {
+		switch ex.kind {
+		case amqp.ExchangeFanout, routing.ExchangeKindConsistentHash:
+		case amqp.ExchangeTopic:
+			if !routing.MatchKey(binding.key, key) {
+				continue
+			}
+		default:
+			if binding.key != key {
+				continue
+			}
+		}
+
+		if binding.exchange != "" {
+			b.routeExchangeLocked(binding.exchange, key, msg, matched, visited)
+			continue
+		}
+		if _, ok := matched[binding.queue]; ok {
+			continue
+		}
+		if queue, ok := b.queues[binding.queue]; ok {
+			matched[binding.queue] = struct{}{}
+			b.enqueueLocked(queue, msg)
+		}
+	}
+}
+
+// hashRingPoints is how many ring points each unit of binding weight owns.
+const hashRingPoints = 100
+
+// consistentHash picks the binding a consistent-hash exchange sends key to, as the plugin does.
+func consistentHash(bindings []memoryBinding, key string) []memoryBinding {
+	hash := func(s string) uint32 {
+		sum := sha256.Sum256([]byte(s))
+		return binary.BigEndian.Uint32(sum[:])
+	}
+
+	target := hash(key)
+	var first, next *memoryBinding
+	var firstPoint, nextPoint uint32
+	for i := range bindings {
+		weight, err := strconv.Atoi(bindings[i].key)
+		if err != nil {
+			continue
+		}
+		for j := 0; j < weight*hashRingPoints; j++ {
+			point := hash(fmt.Sprintf("%s/%s/%d", bindings[i].queue, bindings[i].exchange, j))
+			if first == nil || point < firstPoint {
+				first, firstPoint = &bindings[i], point
+			}
+			if point >= target && (next == nil || point < nextPoint) {
+				next, nextPoint = &bindings[i], point
+			}
+		}
+	}
+
+	switch {
+	case next != nil:
+		return []memoryBinding{*next}
+	case first != nil:
+		return []memoryBinding{*first}
+	default:
+		return nil
+	}
+}
+
+func (b *MemoryBroker) enqueueLocked(queue *memoryQueue, msg memoryMessage) {
+	ttl, ok := tableInt(queue.args, headerMessageTTL)
+	if expiration, err := strconv.ParseInt(msg.publishing.Expiration, 10, 64); err == nil && (!ok || expiration < ttl) {
+		ttl, ok = expiration, true
+	}
+
+	msg.expiresAt = time.Time{}
+	if ok {
+		delay := time.Duration(ttl) * time.Millisecond
+		msg.expiresAt = time.Now().Add(delay)
+		time.AfterFunc(delay, func() { b.expire(queue) })
+	}
+
+	queue.messages = append(queue.messages, msg)
+}
+
+func (b *MemoryBroker) expire(queue *memoryQueue) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if queue.deleted {
+		return
+	}
+
+	now := time.Now()
+	remaining := queue.messages[:0]
+	var expired []memoryMessage
+	for _, msg := range queue.messages {
+		if !msg.expiresAt.IsZero() && !msg.expiresAt.After(now) {
+			expired = append(expired, msg)
+			continue
+		}
+		remaining = append(remaining, msg)
+	}
+	queue.messages = remaining
+
+	for _, msg := range expired {
+		b.deadLetterLocked(queue, msg, "expired")
+	}
+	b.cond.Broadcast()
+}
+
+// touchLocked restarts the queue's x-expires countdown, if it has one.
+func (b *MemoryBroker) touchLocked(queue *memoryQueue) {
+	expires, ok := tableInt(queue.args, headerExpires)
+	if !ok {
+		return
+	}
+
+	queue.uses++
+	uses := queue.uses
+	time.AfterFunc(time.Duration(expires)*time.Millisecond, func() { b.expireQueue(queue, uses) })
+}
+
+// expireQueue deletes the queue, messages and all, if nothing has used it since the countdown began.
+func (b *MemoryBroker) expireQueue(queue *memoryQueue, uses int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if queue.deleted || queue.uses != uses || len(queue.consumers) > 0 {
+		return
+	}
+
+	b.deleteQueueLocked(queue)
+	b.cond.Broadcast()
+}
+
+func (b *MemoryBroker) deadLetterLocked(queue *memoryQueue, msg memoryMessage, reason string) {
+	dlx, ok := queue.args[headerDeadLetterExchange].(string)
+	if !ok {
+		return
+	}
+
+	key := msg.key
+	if dlk, ok := queue.args[headerDeadLetterRoutingKey].(string); ok {
+		key = dlk
+	}
+
+	headers := amqp.Table{}
+	for k, v := range msg.publishing.Headers {
+		headers[k] = v
+	}
+
+	death := amqp.Table{
+		"queue":        queue.name,
+		"reason":       reason,
+		"exchange":     msg.exchange,
+		"routing-keys": []interface{}{msg.key},
+		"count":        int64(1),
+		"time":         time.Now(),
+	}
+	deaths, _ := headers["x-death"].([]interface{})
+	for i, entry := range deaths {
+		previous, ok := entry.(amqp.Table)
+		if ok && previous["queue"] == queue.name && previous["reason"] == reason {
+			count, _ := previous["count"].(int64)
+			death["count"] = count + 1
+			deaths = append(deaths[:i:i], deaths[i+1:]...)
+			break
+		}
+	}
+	headers["x-death"] = append([]interface{}{death}, deaths...)
+
+	if _, ok := headers["x-first-death-queue"]; !ok {
+		headers["x-first-death-queue"] = queue.name
+		headers["x-first-death-reason"] = reason
+		headers["x-first-death-exchange"] = msg.exchange
+	}
+
+	msg.publishing.Headers = headers
+	msg.exchange = dlx
+	msg.key = key
+	msg.redelivered = false
+	b.routeLocked(dlx, key, msg)
+}
+
+func (b *MemoryBroker) deleteQueueLocked(queue *memoryQueue) {
+	if queue.deleted {
+		return
+	}
+	queue.deleted = true
+	delete(b.queues, queue.name)
+
+	for _, ex := range b.exchanges {
+		bindings := ex.bindings[:0]
+		for _, binding := range ex.bindings {
+			if binding.queue != queue.name {
+				bindings = append(bindings, binding)
+			}
+		}
+		ex.bindings = bindings
+	}
+
+	for c := range queue.consumers {
+		c.channel.cancelLocked(c)
+	}
+}
+
+// equivalenceArgs are the queue arguments RabbitMQ requires to match when a queue is redeclared.
+var equivalenceArgs = []string{
+	headerDeadLetterExchange,
+	headerDeadLetterRoutingKey,
+	headerMessageTTL,
+	headerSingleActiveConsumer,
+	headerExpires,
+	"x-max-length",
+	"x-queue-type",
+}
+
+func equivalentArgs(a, b amqp.Table) bool {
+	for _, key := range equivalenceArgs {
+		if fmt.Sprint(a[key]) != fmt.Sprint(b[key]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func tableInt(table amqp.Table, key string) (int64, bool) {
+	switch v := table[key].(type) {
+	case int:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint8:
+		return int64(v), true
+	case uint16:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	case float64:
+		return int64(v), true
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,458 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"testing"
+	"time"
+)
+
+// queueDepth reports how many messages a queue holds, and whether it exists at all.
+func queueDepth(t *testing.T, broker Broker, name string) (int, bool) {
+	t.Helper()
+
+	channel, err := broker.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer channel.Close()
+
+	queue, err := channel.QueueDeclarePassive(name, false, false, false, false, nil)
+	var amqpErr *amqp.Error
+	if errors.As(err, &amqpErr) && amqpErr.Code == amqp.NotFound {
+		return 0, false
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return queue.Messages, true
+}
+
+func publishTo(t *testing.T, channel Channel, exchange, key string) {
+	t.Helper()
+
+	if err := channel.PublishWithContext(context.Background(), exchange, key, false, false, amqp.Publishing{Body: []byte(key)}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryRouting(t *testing.T) {
+	tests := []struct {
+		name    string
+		kind    string
+		binding string
+		key     string
+		routed  bool
+	}{
+		{"topic exact", amqp.ExchangeTopic, "army_moves.washington", "army_moves.washington", true},
+		{"topic exact mismatch", amqp.ExchangeTopic, "army_moves.washington", "army_moves.lincoln", false},
+		{"topic star", amqp.ExchangeTopic, "army_moves.*", "army_moves.washington", true},
+		{"topic star needs a word", amqp.ExchangeTopic, "army_moves.*", "army_moves", false},
+		{"topic star takes one word", amqp.ExchangeTopic, "army_moves.*", "army_moves.washington.europe", false},
+		{"topic star in the middle", amqp.ExchangeTopic, "*.washington", "war.washington", true},
+		{"topic hash takes none", amqp.ExchangeTopic, "game_logs.#", "game_logs", true},
+		{"topic hash takes many", amqp.ExchangeTopic, "game_logs.#", "game_logs.washington.europe", true},
+		{"topic hash alone", amqp.ExchangeTopic, "#", "anything.at.all", true},
+		{"topic hash in the middle", amqp.ExchangeTopic, "war.#.europe", "war.washington.asia.europe", true},
+		{"topic hash then mismatch", amqp.ExchangeTopic, "war.#.europe", "war.washington.asia", false},
+		{"direct exact", amqp.ExchangeDirect, "pause", "pause", true},
+		{"direct ignores wildcards", amqp.ExchangeDirect, "*", "pause", false},
+		{"direct mismatch", amqp.ExchangeDirect, "pause", "resume", false},
+		{"fanout ignores the key", amqp.ExchangeFanout, "pause", "anything", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := NewMemoryBroker()
+			channel := newTestChannel(t, broker)
+			if err := channel.ExchangeDeclare("test_exchange", tt.kind, false, false, false, false, nil); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := channel.QueueDeclare("test_queue", false, false, false, false, nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := channel.QueueBind("test_queue", tt.binding, "test_exchange", false, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			publishTo(t, channel, "test_exchange", tt.key)
+
+			if depth, _ := queueDepth(t, broker, "test_queue"); (depth == 1) != tt.routed {
+				t.Errorf("binding %q, key %q: queue holds %d messages, want routed %v", tt.binding, tt.key, depth, tt.routed)
+			}
+		})
+	}
+}
+
+func TestMemoryQueuesOutliveTheirConnection(t *testing.T) {
+	tests := []struct {
+		name                           string
+		durable, autoDelete, exclusive bool
+		consume                        bool
+		survives                       bool
+	}{
+		{name: "durable", durable: true, survives: true},
+		{name: "durable consumed", durable: true, consume: true, survives: true},
+		{name: "non-durable", survives: true},
+		{name: "exclusive", exclusive: true},
+		{name: "auto-delete consumed", autoDelete: true, consume: true},
+		{name: "transient", autoDelete: true, exclusive: true, consume: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := NewMemoryBroker()
+			conn := broker.Connect()
+			channel, err := conn.Channel()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := channel.QueueDeclare("test_queue", tt.durable, tt.autoDelete, tt.exclusive, false, nil); err != nil {
+				t.Fatal(err)
+			}
+			publishTo(t, channel, "", "test_queue")
+			if tt.consume {
+				if _, err := channel.Consume("test_queue", "", false, false, false, false, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := conn.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			depth, ok := queueDepth(t, broker, "test_queue")
+			if ok != tt.survives {
+				t.Fatalf("queue survived the connection closing: %v, want %v", ok, tt.survives)
+			}
+			// Whatever was delivered but never acked goes back on a surviving queue.
+			if ok && depth != 1 {
+				t.Errorf("surviving queue holds %d messages, want 1", depth)
+			}
+		})
+	}
+}
+
+func TestMemoryNack(t *testing.T) {
+	tests := []struct {
+		name       string
+		settle     func(amqp.Delivery) error
+		deadLetter bool
+		requeued   bool
+	}{
+		{"ack", func(d amqp.Delivery) error { return d.Ack(false) }, false, false},
+		{"nack with requeue", func(d amqp.Delivery) error { return d.Nack(false, true) }, false, true},
+		{"nack without requeue", func(d amqp.Delivery) error { return d.Nack(false, false) }, true, false},
+		{"reject", func(d amqp.Delivery) error { return d.Reject(false) }, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := newTestBroker(t)
+			channel := newTestChannel(t, broker)
+			_, err := channel.QueueDeclare("test_queue", true, false, false, false, amqp.Table{
+				"x-dead-letter-exchange": routing.ExchangePerilDLX,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			publishTo(t, channel, "", "test_queue")
+
+			delivery, ok, err := channel.Get("test_queue", false)
+			if err != nil || !ok {
+				t.Fatalf("got nothing off the queue: %v", err)
+			}
+			if err := tt.settle(delivery); err != nil {
+				t.Fatal(err)
+			}
+
+			if depth, _ := queueDepth(t, broker, "test_queue"); (depth == 1) != tt.requeued {
+				t.Errorf("queue holds %d messages, want requeued %v", depth, tt.requeued)
+			}
+			if depth, _ := queueDepth(t, broker, routing.QueuePerilDLQ); (depth == 1) != tt.deadLetter {
+				t.Errorf("dead-letter queue holds %d messages, want dead-lettered %v", depth, tt.deadLetter)
+			}
+
+			if tt.requeued {
+				again, _, err := channel.Get("test_queue", true)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !again.Redelivered {
+					t.Error("requeued message isn't marked redelivered")
+				}
+			}
+			if tt.deadLetter {
+				letter := NewDeadLetter(deadLetter(t, broker))
+				if len(letter.Deaths) != 1 || letter.Deaths[0].Queue != "test_queue" || letter.Deaths[0].Reason != "rejected" {
+					t.Errorf("deaths %+v, want one rejection from test_queue", letter.Deaths)
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryPrefetch(t *testing.T) {
+	for _, prefetch := range []int{1, 2, 5} {
+		broker := NewMemoryBroker()
+		channel := newTestChannel(t, broker)
+		if _, err := channel.QueueDeclare("test_queue", false, false, false, false, nil); err != nil {
+			t.Fatal(err)
+		}
+		for range 10 {
+			publishTo(t, channel, "", "test_queue")
+		}
+
+		if err := channel.Qos(prefetch, 0, false); err != nil {
+			t.Fatal(err)
+		}
+		deliveries, err := channel.Consume("test_queue", "", false, false, false, false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var held []amqp.Delivery
+		for range prefetch {
+			held = append(held, receive(t, deliveries))
+		}
+		select {
+		case <-deliveries:
+			t.Fatalf("prefetch %d: got a delivery past the limit", prefetch)
+		case <-time.After(20 * time.Millisecond):
+		}
+
+		// Acking one frees room for exactly one more.
+		if err := held[0].Ack(false); err != nil {
+			t.Fatal(err)
+		}
+		receive(t, deliveries)
+		select {
+		case <-deliveries:
+			t.Fatalf("prefetch %d: got two deliveries for one ack", prefetch)
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+}
+
+func TestMemoryInequivalentRedeclare(t *testing.T) {
+	type declare func(Channel) error
+	exchange := func(kind string, durable bool) declare {
+		return func(channel Channel) error {
+			return channel.ExchangeDeclare("test_exchange", kind, durable, false, false, false, nil)
+		}
+	}
+	queue := func(durable bool, args amqp.Table) declare {
+		return func(channel Channel) error {
+			_, err := channel.QueueDeclare("test_queue", durable, false, false, false, args)
+			return err
+		}
+	}
+	dlx := amqp.Table{"x-dead-letter-exchange": routing.ExchangePerilDLX}
+
+	tests := []struct {
+		name          string
+		first, second declare
+		equivalent    bool
+	}{
+		{"same exchange", exchange(amqp.ExchangeTopic, true), exchange(amqp.ExchangeTopic, true), true},
+		{"exchange kind", exchange(amqp.ExchangeTopic, true), exchange(amqp.ExchangeDirect, true), false},
+		{"exchange durability", exchange(amqp.ExchangeTopic, true), exchange(amqp.ExchangeTopic, false), false},
+		{"same queue", queue(true, dlx), queue(true, dlx), true},
+		{"queue durability", queue(true, nil), queue(false, nil), false},
+		{"dead-letter exchange added", queue(true, nil), queue(true, dlx), false},
+		{"dead-letter exchange dropped", queue(true, dlx), queue(true, nil), false},
+		{"message TTL", queue(true, amqp.Table{"x-message-ttl": 1000}), queue(true, amqp.Table{"x-message-ttl": 2000}), false},
+		{"queue expiry", queue(true, amqp.Table{"x-expires": 60000}), queue(true, nil), false},
+		{"irrelevant argument", queue(true, nil), queue(true, amqp.Table{"x-custom": true}), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := NewMemoryBroker()
+			if err := tt.first(newTestChannel(t, broker)); err != nil {
+				t.Fatal(err)
+			}
+
+			channel := newTestChannel(t, broker)
+			err := tt.second(channel)
+			if tt.equivalent {
+				if err != nil {
+					t.Fatalf("equivalent redeclare failed: %v", err)
+				}
+				return
+			}
+
+			var amqpErr *amqp.Error
+			if !errors.As(err, &amqpErr) || amqpErr.Code != amqp.PreconditionFailed {
+				t.Fatalf("got %v, want PRECONDITION_FAILED", err)
+			}
+			// Like RabbitMQ, the failure closes the channel.
+			if _, _, err := channel.Get("test_queue", true); !errors.Is(err, amqp.ErrClosed) {
+				t.Errorf("channel still usable after PRECONDITION_FAILED: %v", err)
+			}
+		})
+	}
+}
+
+func TestMemoryQueueExpires(t *testing.T) {
+	const expires = 30 * time.Millisecond
+	args := amqp.Table{"x-expires": expires.Milliseconds()}
+
+	broker := NewMemoryBroker()
+	channel := newTestChannel(t, broker)
+	for _, name := range []string{"test_unused", "test_redeclared", "test_consumed"} {
+		if _, err := channel.QueueDeclare(name, true, false, false, false, args); err != nil {
+			t.Fatal(err)
+		}
+		publishTo(t, channel, "", name)
+	}
+	consumer, err := broker.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := consumer.Consume("test_consumed", "consumer", false, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for range 4 {
+		time.Sleep(expires / 2)
+		if _, err := channel.QueueDeclare("test_redeclared", true, false, false, false, args); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, ok := queueDepth(t, broker, "test_unused"); ok {
+		t.Error("unused queue outlived x-expires")
+	}
+	if _, ok := queueDepth(t, broker, "test_redeclared"); !ok {
+		t.Error("queue expired while it was being redeclared")
+	}
+	if _, ok := queueDepth(t, broker, "test_consumed"); !ok {
+		t.Error("queue expired while it had a consumer")
+	}
+
+	// Once its last consumer goes, the countdown starts again.
+	if err := consumer.Cancel("consumer", false); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, func() bool {
+		_, ok := queueDepth(t, broker, "test_consumed")
+		return !ok
+	})
+}
+
+func shardBindings(shards ...string) []memoryBinding {
+	var bindings []memoryBinding
+	for _, shard := range shards {
+		bindings = append(bindings, memoryBinding{queue: routing.GameLogShardQueue(shard), exchange: routing.ExchangePerilLogShards, key: routing.LogShardWeight})
+	}
+
+	return bindings
+}
+
+// assignments maps each of n players' log keys to the shard queue it hashes to.
+func assignments(t *testing.T, n int, bindings []memoryBinding) map[string]string {
+	t.Helper()
+
+	assigned := map[string]string{}
+	for i := range n {
+		key := fmt.Sprintf("%s.player%d", routing.GameLogSlug, i)
+		picked := consistentHash(bindings, key)
+		if len(picked) != 1 {
+			t.Fatalf("%s went to %d queues, want one", key, len(picked))
+		}
+		assigned[key] = picked[0].queue
+	}
+
+	return assigned
+}
+
+// TestConsistentHashStable checks that a server joining or leaving only moves the players it takes
+// over or gives up, about its share of them.
+func TestConsistentHashStable(t *testing.T) {
+	const players = 400
+	before := assignments(t, players, shardBindings("a", "b", "c"))
+
+	perShard := map[string]int{}
+	for _, queue := range before {
+		perShard[queue]++
+	}
+	for queue, n := range perShard {
+		if n < players/6 || n > players/2 {
+			t.Errorf("%s got %d of %d players, want about a third", queue, n, players)
+		}
+	}
+
+	joined := assignments(t, players, shardBindings("a", "b", "c", "d"))
+	moved := 0
+	for key, queue := range joined {
+		if queue == before[key] {
+			continue
+		}
+		moved++
+		if queue != routing.GameLogShardQueue("d") {
+			t.Errorf("%s moved from %s to %s, not to the shard that joined", key, before[key], queue)
+		}
+	}
+	if moved == 0 || moved > players/2 {
+		t.Errorf("%d of %d players moved when a fourth shard joined, want about a quarter", moved, players)
+	}
+
+	left := assignments(t, players, shardBindings("a", "c"))
+	for key, queue := range left {
+		if before[key] != routing.GameLogShardQueue("b") && queue != before[key] {
+			t.Errorf("%s moved from %s to %s, though its shard stayed", key, before[key], queue)
+		}
+	}
+}
+
+func TestConsistentHashExchange(t *testing.T) {
+	broker := NewMemoryBroker()
+	if err := ApplyTopology(broker, routing.ShardedPerilTopology); err != nil {
+		t.Fatal(err)
+	}
+	channel := newTestChannel(t, broker)
+	shards := []string{"a", "b", "c"}
+	for _, shard := range shards {
+		if _, _, err := DeclareAndBind(broker, routing.ExchangePerilLogShards, routing.GameLogShardQueue(shard), routing.LogShardWeight, QueueTypeDurable); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Every log reaches exactly one shard, and all of a player's logs the same one.
+	const players = 30
+	for range 2 {
+		for i := range players {
+			publishTo(t, channel, routing.ExchangePerilTopic, fmt.Sprintf("%s.player%d", routing.GameLogSlug, i))
+		}
+	}
+
+	owner := map[string]string{}
+	total := 0
+	for _, shard := range shards {
+		queue := routing.GameLogShardQueue(shard)
+		for {
+			delivery, ok, err := channel.Get(queue, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok {
+				break
+			}
+			total++
+
+			key := string(delivery.Body)
+			if previous, ok := owner[key]; ok && previous != queue {
+				t.Errorf("%s went to both %s and %s", key, previous, queue)
+			}
+			owner[key] = queue
+		}
+	}
+	if total != 2*players {
+		t.Errorf("shards got %d logs, want %d", total, 2*players)
+	}
+}
@@ -0,0 +1,113 @@
+package pubsub
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// Message is a decoded delivery together with the metadata its publisher and the broker attached.
+type Message[T any] struct {
+	Body T
+
+	MessageID     string
+	CorrelationID string
+	ReplyTo       string
+	Timestamp     time.Time
+	AppID         string
+	UserID        string
+	ContentType   string
+	Headers       amqp.Table
+
+	// Exchange and RoutingKey are the ones the message was first published with, even when it has
+	// since come back through a retry queue.
+	Exchange    string
+	RoutingKey  string
+	Redelivered bool
+	// Attempt counts how many times the message has been through RetryLater.
+	Attempt int
+
+	ctx context.Context
+}
+
+// Context carries the trace of the handler the message was delivered to. Publishing with it makes
+// the messages a handler sends part of the same trace as the one it received.
+func (m Message[T]) Context() context.Context {
+	if m.ctx == nil {
+		return context.Background()
+	}
+
+	return m.ctx
+}
+
+func newMessage[T any](body T, delivery amqp.Delivery) Message[T] {
+	exchange := delivery.Exchange
+	if original, ok := delivery.Headers[HeaderOriginalExchange].(string); ok {
+		exchange = original
+	}
+	attempt, _ := tableInt(delivery.Headers, HeaderRetryCount)
+
+	return Message[T]{
+		Body:          body,
+		MessageID:     delivery.MessageId,
+		CorrelationID: delivery.CorrelationId,
+		ReplyTo:       delivery.ReplyTo,
+		Timestamp:     delivery.Timestamp,
+		AppID:         delivery.AppId,
+		UserID:        delivery.UserId,
+		ContentType:   delivery.ContentType,
+		Headers:       delivery.Headers,
+		Exchange:      exchange,
+		RoutingKey:    originalRoutingKey(delivery),
+		Redelivered:   delivery.Redelivered,
+		Attempt:       int(attempt),
+	}
+}
+
+// Identity is stamped on every message published through Publish.
+type Identity struct {
+	AppID string
+	// UserID must match the user the connection authenticated as, or RabbitMQ rejects the message.
+	UserID string
+}
+
+var identity atomic.Pointer[Identity]
+
+func init() {
+	identity.Store(&Identity{AppID: filepath.Base(os.Args[0])})
+}
+
+// SetIdentity replaces the identity stamped on published messages. It defaults to the program name
+// as app ID and no user ID.
+func SetIdentity(id Identity) {
+	identity.Store(&id)
+}
+
+// publishing stamps an encoded body with the metadata every published message carries.
+func (o publishOptions) publishing(body []byte) amqp.Publishing {
+	id := identity.Load()
+	return amqp.Publishing{
+		Headers:       o.headers,
+		ContentType:   o.codec.ContentType(),
+		MessageId:     o.messageID,
+		CorrelationId: o.correlationID,
+		Timestamp:     time.Now(),
+		AppId:         id.AppID,
+		UserId:        id.UserID,
+		Body:          body,
+	}
+}
+
+func newMessageID() string {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(id[:])
+}
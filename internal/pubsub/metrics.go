@@ -0,0 +1,41 @@
+package pubsub
+
+import (
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/metrics"
+)
+
+var (
+	publishedTotal = metrics.Default.NewCounterVec("pubsub_published_total",
+		"Messages published with Publish and PublishBatch.", "exchange")
+	publishErrorsTotal = metrics.Default.NewCounterVec("pubsub_publish_errors_total",
+		"Messages that could not be published or were not confirmed.", "exchange")
+	deliveriesTotal = metrics.Default.NewCounterVec("pubsub_deliveries_total",
+		"Messages delivered to subscriptions.", "queue")
+	acksTotal = metrics.Default.NewCounterVec("pubsub_acks_total",
+		"Deliveries acknowledged.", "queue")
+	requeuesTotal = metrics.Default.NewCounterVec("pubsub_requeues_total",
+		"Deliveries rejected and put back on the queue.", "queue")
+	discardsTotal = metrics.Default.NewCounterVec("pubsub_discards_total",
+		"Deliveries rejected without requeueing, which dead-letters them.", "queue")
+	retriesTotal = metrics.Default.NewCounterVec("pubsub_retries_total",
+		"Deliveries sent to a retry queue.", "queue")
+	duplicatesTotal = metrics.Default.NewCounterVec("pubsub_duplicates_total",
+		"Deliveries dropped as already processed.", "queue")
+	decodeFailuresTotal = metrics.Default.NewCounterVec("pubsub_decode_failures_total",
+		"Deliveries quarantined because they could not be decoded.", "queue")
+	throttledTotal = metrics.Default.NewCounterVec("pubsub_throttled_total",
+		"Deliveries discarded by Throttle for going over their sender's rate limit.", "queue")
+	handlerSeconds = metrics.Default.NewHistogramVec("pubsub_handler_duration_seconds",
+		"Time spent in subscription handlers, middleware included.", metrics.DefaultBuckets, "queue")
+)
+
+// countPublished records the outcome of publishing n messages to exchange.
+func countPublished(exchange string, n int, err error) error {
+	if err != nil {
+		publishErrorsTotal.Add(float64(n), exchange)
+	} else {
+		publishedTotal.Add(float64(n), exchange)
+	}
+
+	return err
+}
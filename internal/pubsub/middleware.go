@@ -0,0 +1,171 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"log/slog"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// Handler is a subscription handler seen from the outside: it gets the raw delivery, after the body
+// has been decoded for the typed handler it ends in, and says how to settle it.
+type Handler func(ctx context.Context, delivery amqp.Delivery) AckType
+
+// Middleware wraps a Handler to add behavior around every delivery.
+type Middleware func(Handler) Handler
+
+var global struct {
+	sync.RWMutex
+	middleware []Middleware
+}
+
+// Use installs middleware on every subscription made after the call, outside any added with
+// WithMiddleware. The first middleware given is the outermost.
+func Use(middleware ...Middleware) {
+	global.Lock()
+	defer global.Unlock()
+
+	global.middleware = append(global.middleware, middleware...)
+}
+
+func globalMiddleware() []Middleware {
+	global.RLock()
+	defer global.RUnlock()
+
+	return append([]Middleware(nil), global.middleware...)
+}
+
+func chain(handler Handler, middleware []Middleware) Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+
+	return handler
+}
+
+type queueKey struct{}
+
+func contextWithQueue(ctx context.Context, queue string) context.Context {
+	return context.WithValue(ctx, queueKey{}, queue)
+}
+
+func deliveryAttrs(ctx context.Context, delivery amqp.Delivery, extra ...any) []any {
+	queue, _ := ctx.Value(queueKey{}).(string)
+	return append([]any{
+		slog.String("queue", queue),
+		slog.String("routing_key", originalRoutingKey(delivery)),
+		slog.String("message_id", delivery.MessageId),
+	}, extra...)
+}
+
+func (a AckType) String() string {
+	switch a {
+	case Ack:
+		return "Ack"
+	case NackRequeue:
+		return "NackRequeue"
+	case NackDiscard:
+		return "NackDiscard"
+	case RetryLater:
+		return "RetryLater"
+	default:
+		return fmt.Sprintf("AckType(%d)", int(a))
+	}
+}
+
+// Logging logs how each delivery was settled.
+func Logging() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, delivery amqp.Delivery) AckType {
+			ackType := next(ctx, delivery)
+			slog.InfoContext(ctx, "Handled message", deliveryAttrs(ctx, delivery, slog.String("outcome", ackType.String()))...)
+			return ackType
+		}
+	}
+}
+
+// Timing logs deliveries whose handler took longer than threshold.
+func Timing(threshold time.Duration) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, delivery amqp.Delivery) AckType {
+			start := time.Now()
+			ackType := next(ctx, delivery)
+			if elapsed := time.Since(start); elapsed > threshold {
+				slog.WarnContext(ctx, "Slow handler", deliveryAttrs(ctx, delivery, slog.Duration("elapsed", elapsed))...)
+			}
+			return ackType
+		}
+	}
+}
+
+// Recover turns a panicking handler into a NackDiscard, so one bad message is dead-lettered
+// instead of taking the process down.
+func Recover() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, delivery amqp.Delivery) (ackType AckType) {
+			defer func() {
+				if r := recover(); r != nil {
+					slog.ErrorContext(ctx, "Handler panicked", deliveryAttrs(ctx, delivery, slog.Any("panic", r), slog.String("stack", string(debug.Stack())))...)
+					ackType = NackDiscard
+				}
+			}()
+
+			return next(ctx, delivery)
+		}
+	}
+}
+
+// Prompt reprints an interactive prompt after each delivery, since handler output otherwise leaves
+// a REPL without one.
+func Prompt(prompt string) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, delivery amqp.Delivery) AckType {
+			defer fmt.Print(prompt)
+			return next(ctx, delivery)
+		}
+	}
+}
+
+// Authorize discards deliveries that check rejects, without calling the handler.
+func Authorize(check func(amqp.Delivery) error) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, delivery amqp.Delivery) AckType {
+			if err := check(delivery); err != nil {
+				slog.WarnContext(ctx, "Rejecting unauthorized message", deliveryAttrs(ctx, delivery, slog.Any("error", err))...)
+				return NackDiscard
+			}
+			return next(ctx, delivery)
+		}
+	}
+}
+
+// FromUser is an Authorize check that only lets through messages published by the given broker
+// users. RabbitMQ rejects messages whose user ID isn't the user the publisher logged in as, so unlike
+// the app ID it can't be forged.
+func FromUser(userIDs ...string) func(amqp.Delivery) error {
+	return func(delivery amqp.Delivery) error {
+		for _, userID := range userIDs {
+			if delivery.UserId == userID {
+				return nil
+			}
+		}
+		return fmt.Errorf("user %q is not allowed", delivery.UserId)
+	}
+}
+
+// FromApp is an Authorize check that only lets through messages published by the given apps. The
+// publisher sets its own app ID, so this only filters out messages sent by mistake; use FromUser to
+// keep out publishers that lie.
+func FromApp(appIDs ...string) func(amqp.Delivery) error {
+	return func(delivery amqp.Delivery) error {
+		for _, appID := range appIDs {
+			if delivery.AppId == appID {
+				return nil
+			}
+		}
+		return fmt.Errorf("app %q is not allowed", delivery.AppId)
+	}
+}
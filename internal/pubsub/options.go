@@ -0,0 +1,170 @@
+package pubsub
+
+import (
+	"context"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/codec"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type SubscribeOption func(*subscribeOptions)
+
+type subscribeOptions struct {
+	onDecodeError func(*DecodeError)
+	retryPolicy   RetryPolicy
+	defaultCodec  codec.Codec
+	prefetch      int
+	globalQos     bool
+	workers       int
+	keyOrdering   bool
+	dedupe        DedupeStore
+	middleware    []Middleware
+	throttle      *throttle
+}
+
+func newSubscribeOptions(opts []SubscribeOption) subscribeOptions {
+	options := subscribeOptions{
+		retryPolicy:  DefaultRetryPolicy,
+		defaultCodec: codec.JSON,
+		prefetch:     10,
+		globalQos:    true,
+		workers:      1,
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	return options
+}
+
+// OnDecodeError registers a hook that is told about every delivery that could not be decoded.
+// The delivery has already been quarantined to the dead-letter exchange when the hook runs.
+func OnDecodeError(hook func(*DecodeError)) SubscribeOption {
+	return func(options *subscribeOptions) {
+		options.onDecodeError = hook
+	}
+}
+
+// WithRetryPolicy controls how RetryLater deliveries are delayed and when they are given up on.
+func WithRetryPolicy(policy RetryPolicy) SubscribeOption {
+	return func(options *subscribeOptions) {
+		options.retryPolicy = policy
+	}
+}
+
+// WithDefaultCodec sets the codec used for deliveries that arrive without a content type.
+func WithDefaultCodec(c codec.Codec) SubscribeOption {
+	return func(options *subscribeOptions) {
+		options.defaultCodec = c
+	}
+}
+
+// WithPrefetch limits how many unacknowledged deliveries the broker sends before waiting for acks.
+// It should be at least the number of workers, or some of them will sit idle.
+func WithPrefetch(count int) SubscribeOption {
+	return func(options *subscribeOptions) {
+		options.prefetch = count
+	}
+}
+
+// WithGlobalQos chooses whether the prefetch limit is shared across the channel or applies to each
+// consumer separately.
+func WithGlobalQos(global bool) SubscribeOption {
+	return func(options *subscribeOptions) {
+		options.globalQos = global
+	}
+}
+
+// WithWorkers runs the handler on n goroutines instead of one.
+func WithWorkers(n int) SubscribeOption {
+	return func(options *subscribeOptions) {
+		options.workers = n
+	}
+}
+
+// WithKeyOrdering keeps deliveries with the same routing key in order when running several workers,
+// by always handing them to the same worker.
+func WithKeyOrdering() SubscribeOption {
+	return func(options *subscribeOptions) {
+		options.keyOrdering = true
+	}
+}
+
+// WithDedupe skips deliveries whose message ID the store has already seen processed, acking them
+// without calling the handler. A message counts as processed once its handler returns Ack.
+func WithDedupe(store DedupeStore) SubscribeOption {
+	return func(options *subscribeOptions) {
+		options.dedupe = store
+	}
+}
+
+// WithMiddleware wraps this subscription's handler, inside any middleware installed with Use. The
+// first middleware given is the outermost.
+func WithMiddleware(middleware ...Middleware) SubscribeOption {
+	return func(options *subscribeOptions) {
+		options.middleware = append(options.middleware, middleware...)
+	}
+}
+
+// WithThrottle discards deliveries as Throttle does, but as they arrive rather than once a worker
+// takes them up. By then a slow handler has given the limiter time to refill, so a sender flooding
+// the queue would be let through at the handler's pace instead of being discarded.
+func WithThrottle(limiter *KeyedLimiter, key func(amqp.Delivery) string, limited func(ctx context.Context, key string)) SubscribeOption {
+	return func(options *subscribeOptions) {
+		options.throttle = &throttle{limiter: limiter, key: key, limited: limited}
+	}
+}
+
+type PublishOption func(*publishOptions)
+
+type publishOptions struct {
+	codec         codec.Codec
+	messageID     string
+	correlationID string
+	headers       amqp.Table
+	mandatory     bool
+}
+
+func newPublishOptions(opts []PublishOption) publishOptions {
+	options := publishOptions{codec: codec.JSON, messageID: newMessageID()}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	return options
+}
+
+// WithCodec picks the codec a message body is encoded with.
+func WithCodec(c codec.Codec) PublishOption {
+	return func(options *publishOptions) {
+		options.codec = c
+	}
+}
+
+// WithMessageID replaces the generated message ID, for republishing a message under its own ID.
+func WithMessageID(id string) PublishOption {
+	return func(options *publishOptions) {
+		options.messageID = id
+	}
+}
+
+// WithCorrelationID links a message to the one that caused it.
+func WithCorrelationID(id string) PublishOption {
+	return func(options *publishOptions) {
+		options.correlationID = id
+	}
+}
+
+// WithMandatory has the broker return the message if no queue is bound to receive it, which a
+// ConfirmedPublisher reports as ErrUnroutable. Leave it off for broadcasts nobody may be listening to.
+func WithMandatory() PublishOption {
+	return func(options *publishOptions) {
+		options.mandatory = true
+	}
+}
+
+// WithHeaders attaches application headers to a message.
+func WithHeaders(headers amqp.Table) PublishOption {
+	return func(options *publishOptions) {
+		options.headers = headers
+	}
+}
@@ -0,0 +1,54 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	HeaderDecodeError        = "x-decode-error"
+	HeaderTargetType         = "x-target-type"
+	HeaderOriginalExchange   = "x-original-exchange"
+	HeaderOriginalRoutingKey = "x-original-routing-key"
+	HeaderOriginalQueue      = "x-original-queue"
+)
+
+type DecodeError struct {
+	Err        error
+	TargetType string
+	Queue      string
+	Delivery   amqp.Delivery
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("could not decode message from %s (key %q) into %s: %v", e.Queue, e.Delivery.RoutingKey, e.TargetType, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// quarantine moves an undecodable delivery to the dead-letter exchange.
+func quarantine(ctx context.Context, channel Publisher, decodeErr *DecodeError) error {
+	delivery := decodeErr.Delivery
+
+	headers := amqp.Table{}
+	for k, v := range delivery.Headers {
+		headers[k] = v
+	}
+	headers[HeaderDecodeError] = decodeErr.Err.Error()
+	headers[HeaderTargetType] = decodeErr.TargetType
+	headers[HeaderOriginalExchange] = delivery.Exchange
+	headers[HeaderOriginalRoutingKey] = delivery.RoutingKey
+	headers[HeaderOriginalQueue] = decodeErr.Queue
+
+	err := channel.PublishWithContext(ctx, routing.ExchangePerilDLX, delivery.RoutingKey, false, false, republishing(delivery, headers))
+	if err != nil {
+		// Fall back to the queue's own dead-lettering, which loses the annotations but not the message.
+		return delivery.Nack(false, false)
+	}
+
+	return delivery.Ack(false)
+}
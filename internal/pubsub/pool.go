@@ -0,0 +1,120 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"sync"
+)
+
+var ErrPublisherPoolClosed = errors.New("publisher pool is closed")
+
+// PublisherPool is a Publisher that is safe to use from any goroutine. It owns a fixed number of
+// confirm-mode channels and lends each publish one of them, so concurrent publishers never share a
+// channel and a slow confirmation only holds up its own caller. A channel the broker closes after
+// a failed publish is replaced the next time its slot is used.
+type PublisherPool struct {
+	broker  Broker
+	options ConfirmOptions
+	slots   chan *ConfirmedPublisher
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func NewPublisherPool(broker Broker, size int, options ConfirmOptions) (*PublisherPool, error) {
+	if size < 1 {
+		size = 1
+	}
+
+	pool := &PublisherPool{
+		broker:  broker,
+		options: options,
+		slots:   make(chan *ConfirmedPublisher, size),
+		done:    make(chan struct{}),
+	}
+
+	for i := 0; i < size; i++ {
+		publisher, err := pool.open()
+		if err != nil {
+			for len(pool.slots) > 0 {
+				(<-pool.slots).channel.Close()
+			}
+			return nil, err
+		}
+		pool.slots <- publisher
+	}
+
+	return pool, nil
+}
+
+func (p *PublisherPool) open() (*ConfirmedPublisher, error) {
+	channel, err := p.broker.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	publisher, err := NewConfirmedPublisher(channel, p.options)
+	if err != nil {
+		channel.Close()
+		return nil, err
+	}
+
+	return publisher, nil
+}
+
+func (p *PublisherPool) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	return p.publishAll(ctx, []outgoing{{exchange: exchange, key: key, mandatory: mandatory, immediate: immediate, publishing: msg}})
+}
+
+// publishAll publishes the messages on a single channel, so they reach the broker in order.
+func (p *PublisherPool) publishAll(ctx context.Context, messages []outgoing) error {
+	var publisher *ConfirmedPublisher
+	select {
+	case publisher = <-p.slots:
+	case <-p.done:
+		return ErrPublisherPoolClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if publisher == nil {
+		var err error
+		if publisher, err = p.open(); err != nil {
+			p.slots <- nil
+			return err
+		}
+	}
+
+	err := publisher.publishAll(ctx, messages)
+
+	// Errors from the broker close the channel they happened on.
+	var amqpErr *amqp.Error
+	if errors.As(err, &amqpErr) {
+		publisher.channel.Close()
+		publisher = nil
+	}
+	p.slots <- publisher
+
+	return err
+}
+
+// Close waits for publishes in flight and closes every channel. Publishing afterwards fails with
+// ErrPublisherPoolClosed.
+func (p *PublisherPool) Close() error {
+	var err error
+	p.closeOnce.Do(func() {
+		close(p.done)
+		for i := 0; i < cap(p.slots); i++ {
+			publisher := <-p.slots
+			if publisher == nil {
+				continue
+			}
+			if closeErr := publisher.channel.Close(); closeErr != nil && err == nil {
+				err = closeErr
+			}
+		}
+	})
+
+	return err
+}
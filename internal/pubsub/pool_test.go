@@ -0,0 +1,176 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/codec"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"sync"
+	"testing"
+)
+
+// countingBroker remembers every channel it hands out.
+type countingBroker struct {
+	Broker
+
+	mu       sync.Mutex
+	channels []Channel
+}
+
+func (b *countingBroker) Channel() (Channel, error) {
+	channel, err := b.Broker.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.channels = append(b.channels, channel)
+	return channel, nil
+}
+
+func (b *countingBroker) opened() []Channel {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]Channel(nil), b.channels...)
+}
+
+func newTestPool(t *testing.T, size int) (*PublisherPool, *countingBroker, *MemoryBroker) {
+	t.Helper()
+
+	memory := newTestBroker(t)
+	if _, _, err := DeclareAndBind(memory, routing.ExchangePerilTopic, "test_pool", "test_pool.*", QueueTypeDurable); err != nil {
+		t.Fatal(err)
+	}
+
+	broker := &countingBroker{Broker: memory}
+	pool, err := NewPublisherPool(broker, size, ConfirmOptions{Timeout: testTimeout})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pool.Close() })
+
+	return pool, broker, memory
+}
+
+func TestPublisherPoolConcurrent(t *testing.T) {
+	const size, publishers, rounds, batch = 3, 16, 10, 4
+	pool, broker, memory := newTestPool(t, size)
+
+	var wg sync.WaitGroup
+	for p := range publishers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for round := range rounds {
+				if err := Publish(context.Background(), pool, routing.ExchangePerilTopic, "test_pool.single", testMove{Units: []int{p, round}}); err != nil {
+					t.Error(err)
+					return
+				}
+
+				moves := make([]testMove, batch)
+				for i := range moves {
+					moves[i] = testMove{Player: "batch", Units: []int{p, round, i}}
+				}
+				if err := PublishBatch(context.Background(), pool, routing.ExchangePerilTopic, "test_pool.batch", moves); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if opened := len(broker.opened()); opened != size {
+		t.Errorf("opened %d channels, want the pool's %d reused", opened, size)
+	}
+
+	// A batch goes out on one channel, so its messages stay in order even among other publishers'.
+	channel := newTestChannel(t, memory)
+	total := 0
+	next := map[[2]int]int{}
+	for {
+		delivery, ok, err := channel.Get("test_pool", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			break
+		}
+		total++
+
+		var move testMove
+		if err := codec.JSON.Unmarshal(delivery.Body, &move); err != nil {
+			t.Fatal(err)
+		}
+		if move.Player != "batch" {
+			continue
+		}
+		id := [2]int{move.Units[0], move.Units[1]}
+		if move.Units[2] != next[id] {
+			t.Errorf("batch %v: got message %d, want %d", id, move.Units[2], next[id])
+		}
+		next[id] = move.Units[2] + 1
+	}
+	if want := publishers * rounds * (1 + batch); total != want {
+		t.Errorf("queue got %d messages, want %d", total, want)
+	}
+}
+
+func TestPublisherPoolReplacesFailedChannels(t *testing.T) {
+	pool, broker, _ := newTestPool(t, 1)
+
+	var amqpErr *amqp.Error
+	err := Publish(context.Background(), pool, "no_such_exchange", "test_pool.washington", testMove{})
+	if !errors.As(err, &amqpErr) || amqpErr.Code != amqp.NotFound {
+		t.Fatalf("got %v, want the broker's error", err)
+	}
+
+	if err := Publish(context.Background(), pool, routing.ExchangePerilTopic, "test_pool.washington", testMove{}); err != nil {
+		t.Fatalf("publish after a failure: %v", err)
+	}
+	if opened := len(broker.opened()); opened != 2 {
+		t.Errorf("opened %d channels, want the failed one replaced once", opened)
+	}
+}
+
+func TestPublisherPoolClose(t *testing.T) {
+	pool, broker, _ := newTestPool(t, 2)
+
+	// Publishes racing Close either finish or are refused, never sent on a closed channel.
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 20 {
+				err := Publish(context.Background(), pool, routing.ExchangePerilTopic, "test_pool.washington", testMove{})
+				if errors.Is(err, ErrPublisherPoolClosed) {
+					return
+				}
+				if err != nil {
+					t.Errorf("publish while closing: %v", err)
+					return
+				}
+			}
+		}()
+	}
+
+	if err := pool.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	if err := Publish(context.Background(), pool, routing.ExchangePerilTopic, "test_pool.washington", testMove{}); !errors.Is(err, ErrPublisherPoolClosed) {
+		t.Errorf("got %v after Close, want ErrPublisherPoolClosed", err)
+	}
+	for _, channel := range broker.opened() {
+		if !channel.(*memoryChannel).IsClosed() {
+			t.Error("Close left a channel open")
+		}
+	}
+	if err := pool.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+}
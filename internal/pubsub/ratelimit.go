@@ -0,0 +1,210 @@
+package pubsub
+
+import (
+	"context"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// TokenBucket is a rate limiter that allows bursts: it holds up to burst tokens, gains rate tokens
+// a second, and each message spends one. It is safe to use from any goroutine.
+type TokenBucket struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket starts full, so the first burst messages go through at once. rate must be
+// positive.
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &TokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// refill adds the tokens earned since the last call. It must be called with b.mu held.
+func (b *TokenBucket) refill(now time.Time) {
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// Allow spends a token if there is one, without waiting.
+func (b *TokenBucket) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(time.Now())
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (b *TokenBucket) Wait(ctx context.Context) error {
+	_, err := b.Take(ctx, 1)
+	return err
+}
+
+// Take waits until there is at least one token, then spends as many as are available up to max and
+// returns how many it spent.
+func (b *TokenBucket) Take(ctx context.Context, max int) (int, error) {
+	for {
+		b.mu.Lock()
+		b.refill(time.Now())
+		if b.tokens >= 1 {
+			n := min(int(b.tokens), max)
+			b.tokens -= float64(n)
+			b.mu.Unlock()
+			return n, nil
+		}
+		wait := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+		b.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return 0, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// full reports whether the bucket has refilled completely, so dropping it changes nothing.
+func (b *TokenBucket) full(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+// keyedLimiterSweep is how often a KeyedLimiter drops buckets nobody has used for a while.
+const keyedLimiterSweep = time.Minute
+
+// KeyedLimiter keeps a TokenBucket per key, such as per player, all with the same rate and burst.
+type KeyedLimiter struct {
+	rate  float64
+	burst int
+
+	mu        sync.Mutex
+	buckets   map[string]*TokenBucket
+	lastSweep time.Time
+}
+
+func NewKeyedLimiter(rate float64, burst int) *KeyedLimiter {
+	return &KeyedLimiter{rate: rate, burst: burst, buckets: map[string]*TokenBucket{}, lastSweep: time.Now()}
+}
+
+// Allow spends a token from key's bucket if there is one, without waiting.
+func (l *KeyedLimiter) Allow(key string) bool {
+	now := time.Now()
+
+	l.mu.Lock()
+	if now.Sub(l.lastSweep) > keyedLimiterSweep {
+		for k, bucket := range l.buckets {
+			if bucket.full(now) {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = NewTokenBucket(l.rate, l.burst)
+		l.buckets[key] = bucket
+	}
+	l.mu.Unlock()
+
+	return bucket.Allow()
+}
+
+// RateLimitedPublisher is a Publisher that waits for a token from its limiter before each message.
+// Batches go out in chunks as tokens become available, rather than all at once after the wait.
+type RateLimitedPublisher struct {
+	publisher Publisher
+	limiter   *TokenBucket
+}
+
+func NewRateLimitedPublisher(publisher Publisher, limiter *TokenBucket) *RateLimitedPublisher {
+	return &RateLimitedPublisher{publisher: publisher, limiter: limiter}
+}
+
+func (p *RateLimitedPublisher) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	if err := p.limiter.Wait(ctx); err != nil {
+		return err
+	}
+
+	return p.publisher.PublishWithContext(ctx, exchange, key, mandatory, immediate, msg)
+}
+
+func (p *RateLimitedPublisher) publishAll(ctx context.Context, messages []outgoing) error {
+	for len(messages) > 0 {
+		n, err := p.limiter.Take(ctx, len(messages))
+		if err != nil {
+			return err
+		}
+		chunk := messages[:n]
+		messages = messages[n:]
+
+		if batch, ok := p.publisher.(batchPublisher); ok {
+			if err := batch.publishAll(ctx, chunk); err != nil {
+				return err
+			}
+			continue
+		}
+		for _, m := range chunk {
+			if err := p.publisher.PublishWithContext(ctx, m.exchange, m.key, m.mandatory, m.immediate, m.publishing); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Throttle discards deliveries beyond what limiter allows for their key, as returned by key, so one
+// sender can't crowd out the rest. Deliveries with an empty key are not limited. limited, if not nil,
+// is called for each discarded delivery. Behind slow handlers, use WithThrottle instead.
+func Throttle(limiter *KeyedLimiter, key func(amqp.Delivery) string, limited func(ctx context.Context, key string)) Middleware {
+	t := throttle{limiter: limiter, key: key, limited: limited}
+	return func(next Handler) Handler {
+		return func(ctx context.Context, delivery amqp.Delivery) AckType {
+			if !t.allow(ctx, delivery) {
+				return NackDiscard
+			}
+			return next(ctx, delivery)
+		}
+	}
+}
+
+// throttle is the check behind Throttle and WithThrottle.
+type throttle struct {
+	limiter *KeyedLimiter
+	key     func(amqp.Delivery) string
+	limited func(ctx context.Context, key string)
+}
+
+// allow reports whether delivery is within its key's limit, counting and reporting it when it isn't.
+func (t throttle) allow(ctx context.Context, delivery amqp.Delivery) bool {
+	k := t.key(delivery)
+	if k == "" || t.limiter.Allow(k) {
+		return true
+	}
+
+	queue, _ := ctx.Value(queueKey{}).(string)
+	throttledTotal.Inc(queue)
+	slog.WarnContext(ctx, "Throttling message", deliveryAttrs(ctx, delivery, slog.String("key", k))...)
+	if t.limited != nil {
+		t.limited(ctx, k)
+	}
+	return false
+}
@@ -0,0 +1,170 @@
+package pubsub
+
+import (
+	"context"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	bucket := NewTokenBucket(1000, 3)
+	for i := range 3 {
+		if !bucket.Allow() {
+			t.Fatalf("token %d of a burst of 3 refused", i+1)
+		}
+	}
+	if bucket.Allow() {
+		t.Error("allowed more than the burst at once")
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	if !bucket.Allow() {
+		t.Error("no token after the bucket had time to refill")
+	}
+}
+
+func TestTokenBucketTake(t *testing.T) {
+	bucket := NewTokenBucket(0.001, 2)
+	n, err := bucket.Take(context.Background(), 5)
+	if err != nil || n != 2 {
+		t.Fatalf("Take got %d, %v, want the 2 tokens in the bucket", n, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := bucket.Take(ctx, 1); err != context.DeadlineExceeded {
+		t.Errorf("Take on an empty bucket got %v, want it to give up with the context", err)
+	}
+}
+
+func TestKeyedLimiter(t *testing.T) {
+	limiter := NewKeyedLimiter(0.001, 1)
+	if !limiter.Allow("washington") || limiter.Allow("washington") {
+		t.Error("washington's bucket doesn't hold exactly one token")
+	}
+	if !limiter.Allow("lincoln") {
+		t.Error("lincoln was limited by washington's use")
+	}
+}
+
+func TestRateLimitedPublisher(t *testing.T) {
+	broker := newTestBroker(t)
+	publisher := NewRateLimitedPublisher(newTestChannel(t, broker), NewTokenBucket(50, 2))
+
+	start := time.Now()
+	if err := PublishBatch(context.Background(), publisher, routing.ExchangePerilTopic, "test_limited.washington", make([]testMove, 5)); err != nil {
+		t.Fatal(err)
+	}
+	// Two go out at once and the other three wait 20ms each.
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("published 5 messages in %v, faster than the limit allows", elapsed)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	broker := newTestBroker(t)
+
+	var mu sync.Mutex
+	handled := map[string]int{}
+	limited := map[string]int{}
+	subscription, err := SubscribeMessage(context.Background(), broker, routing.ExchangePerilTopic, "test_throttle", "test_throttle.*", QueueTypeDurable, func(message Message[testMove]) AckType {
+		mu.Lock()
+		handled[message.Body.Player]++
+		mu.Unlock()
+		return Ack
+	}, WithMiddleware(Throttle(NewKeyedLimiter(0.001, 2), func(delivery amqp.Delivery) string {
+		return delivery.RoutingKey
+	}, func(_ context.Context, key string) {
+		mu.Lock()
+		limited[key]++
+		mu.Unlock()
+	})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscription.Close()
+
+	publisher := newTestChannel(t, broker)
+	for range 5 {
+		if err := Publish(context.Background(), publisher, routing.ExchangePerilTopic, "test_throttle.washington", testMove{Player: "washington"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := Publish(context.Background(), publisher, routing.ExchangePerilTopic, "test_throttle.lincoln", testMove{Player: "lincoln"}); err != nil {
+		t.Fatal(err)
+	}
+
+	eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return handled["washington"]+limited["test_throttle.washington"] == 5 && handled["lincoln"] == 1
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	if handled["washington"] != 2 || limited["test_throttle.washington"] != 3 {
+		t.Errorf("handled %d of washington's messages and throttled %d, want 2 and 3", handled["washington"], limited["test_throttle.washington"])
+	}
+
+	// Throttled messages are dead-lettered.
+	deadLetter(t, broker)
+}
+
+// TestWithThrottleSlowHandler floods a handler slower than the limiter refills. A throttle in
+// middleware would see one delivery per handler call, each with a fresh token, and let them all by.
+func TestWithThrottleSlowHandler(t *testing.T) {
+	broker := newTestBroker(t)
+
+	var mu sync.Mutex
+	handled := map[string]int{}
+	limited := map[string]int{}
+	subscription, err := SubscribeMessage(context.Background(), broker, routing.ExchangePerilTopic, "test_throttle", "test_throttle.*", QueueTypeDurable, func(message Message[testMove]) AckType {
+		time.Sleep(150 * time.Millisecond)
+		mu.Lock()
+		handled[message.Body.Player]++
+		mu.Unlock()
+		return Ack
+	}, WithPrefetch(20), WithThrottle(NewKeyedLimiter(10, 2), func(delivery amqp.Delivery) string {
+		return delivery.RoutingKey
+	}, func(_ context.Context, key string) {
+		mu.Lock()
+		limited[key]++
+		mu.Unlock()
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscription.Close()
+
+	publisher := newTestChannel(t, broker)
+	for range 6 {
+		if err := Publish(context.Background(), publisher, routing.ExchangePerilTopic, "test_throttle.washington", testMove{Player: "washington"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Throttled deliveries are settled as they arrive, without waiting behind the handler.
+	eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return limited["test_throttle.washington"] >= 3
+	})
+	mu.Lock()
+	if handled["washington"] > 1 {
+		t.Errorf("handled %d messages before the throttled ones were reported, want them reported first", handled["washington"])
+	}
+	mu.Unlock()
+
+	eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return handled["washington"]+limited["test_throttle.washington"] == 6
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	if handled["washington"] > 3 {
+		t.Errorf("handled %d of washington's messages and throttled %d, want about the burst of 2 handled", handled["washington"], limited["test_throttle.washington"])
+	}
+}
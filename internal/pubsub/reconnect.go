@@ -0,0 +1,834 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrServerNamedQueue = errors.New("managed connections cannot restore server-named queues")
+
+type Backoff struct {
+	Initial time.Duration
+	Max     time.Duration
+}
+
+var DefaultBackoff = Backoff{Initial: 500 * time.Millisecond, Max: 30 * time.Second}
+
+func (b Backoff) Delay(attempt int) time.Duration {
+	delay := b.Initial
+	for i := 0; i < attempt && delay < b.Max; i++ {
+		delay *= 2
+	}
+
+	if delay > b.Max {
+		return b.Max
+	}
+
+	return delay
+}
+
+// ManagedConnection is a Broker that survives broker restarts. It remembers every exchange, queue
+// and binding declared through its channels, and on reconnect re-declares them, restores QoS
+// settings, re-attaches consumers and swaps the underlying channel behind every handed-out Channel.
+// Queues declared through it must be named, since a server-named queue would come back renamed.
+type ManagedConnection struct {
+	dial    func() (liveConnection, error)
+	backoff Backoff
+
+	mu       sync.Mutex
+	conn     liveConnection
+	topology []topologyStep
+	channels map[*managedChannel]struct{}
+	lost     []func()
+	closed   bool
+}
+
+// liveConnection is what ManagedConnection watches and opens channels on: a RabbitMQ connection or
+// a MemoryBroker's.
+type liveConnection interface {
+	channel() (liveChannel, error)
+	NotifyClose(receiver chan *amqp.Error) chan *amqp.Error
+	IsClosed() bool
+	Close() error
+}
+
+type liveChannel interface {
+	Channel
+	NotifyClose(receiver chan *amqp.Error) chan *amqp.Error
+	IsClosed() bool
+}
+
+type amqpConnection struct {
+	*amqp.Connection
+}
+
+func (c amqpConnection) channel() (liveChannel, error) {
+	channel, err := c.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	return channel, nil
+}
+
+type topologyStep struct {
+	id      string
+	declare func(liveChannel) error
+	// refs counts the channels that declared it and still want it replayed.
+	refs int
+}
+
+type managedChannel struct {
+	conn *ManagedConnection
+
+	mu        sync.RWMutex
+	ch        liveChannel
+	qos       func(liveChannel) error
+	consumers map[string]*managedConsumer
+	nextTag   int
+	closed    bool
+	declared  map[string]struct{}
+
+	confirm   bool
+	published uint64
+	confirmed uint64
+	confirms  []chan amqp.Confirmation
+	returns   []chan amqp.Return
+}
+
+type managedConsumer struct {
+	queue       string
+	tag         string
+	autoAck     bool
+	exclusive   bool
+	noLocal     bool
+	args        amqp.Table
+	out         chan amqp.Delivery
+	generations chan generation
+	done        chan struct{}
+	stop        sync.Once
+	cancelled   atomic.Bool
+}
+
+// generation is the delivery stream of one underlying channel, which closed reports the end of.
+type generation struct {
+	deliveries <-chan amqp.Delivery
+	closed     chan *amqp.Error
+}
+
+func DialManaged(url string) (*ManagedConnection, error) {
+	return DialManagedConfig(url, amqp.Config{Locale: "en_US"}, DefaultBackoff)
+}
+
+func DialManagedConfig(url string, config amqp.Config, backoff Backoff) (*ManagedConnection, error) {
+	return dialManaged(func() (liveConnection, error) {
+		conn, err := amqp.DialConfig(url, config)
+		if err != nil {
+			return nil, err
+		}
+
+		return amqpConnection{conn}, nil
+	}, backoff)
+}
+
+// DialManagedMemory connects a ManagedConnection to an in-memory broker, whose Restart then
+// exercises reconnecting.
+func DialManagedMemory(broker *MemoryBroker, backoff Backoff) (*ManagedConnection, error) {
+	return dialManaged(func() (liveConnection, error) {
+		return broker.Connect(), nil
+	}, backoff)
+}
+
+func dialManaged(dial func() (liveConnection, error), backoff Backoff) (*ManagedConnection, error) {
+	m := &ManagedConnection{
+		dial:     dial,
+		backoff:  backoff,
+		channels: map[*managedChannel]struct{}{},
+	}
+
+	conn, err := dial()
+	if err != nil {
+		return nil, err
+	}
+
+	m.conn = conn
+	go m.watch(conn, conn.NotifyClose(make(chan *amqp.Error, 1)))
+
+	return m, nil
+}
+
+func (m *ManagedConnection) Channel() (Channel, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil, amqp.ErrClosed
+	}
+
+	c := &managedChannel{conn: m, consumers: map[string]*managedConsumer{}, declared: map[string]struct{}{}}
+	if err := c.open(m.conn); err != nil {
+		return nil, err
+	}
+	m.channels[c] = struct{}{}
+
+	return c, nil
+}
+
+func (m *ManagedConnection) Close() error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return amqp.ErrClosed
+	}
+	m.closed = true
+	conn := m.conn
+	channels := m.channels
+	m.channels = map[*managedChannel]struct{}{}
+	m.mu.Unlock()
+
+	for c := range channels {
+		c.shutdown()
+	}
+
+	if conn.IsClosed() {
+		return nil
+	}
+
+	return conn.Close()
+}
+
+func (m *ManagedConnection) IsClosed() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.closed
+}
+
+func (m *ManagedConnection) record(id string, declare func(liveChannel) error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.topology {
+		if m.topology[i].id == id {
+			m.topology[i].refs++
+			return
+		}
+	}
+	m.topology = append(m.topology, topologyStep{id: id, declare: declare, refs: 1})
+}
+
+func (m *ManagedConnection) release(ids []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, id := range ids {
+		for i := range m.topology {
+			if m.topology[i].id == id {
+				if m.topology[i].refs--; m.topology[i].refs == 0 {
+					m.topology = append(m.topology[:i], m.topology[i+1:]...)
+				}
+				break
+			}
+		}
+	}
+}
+
+func (m *ManagedConnection) onLost(f func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lost = append(m.lost, f)
+}
+
+// forget stops replaying the declaration recorded under id.
+func (m *ManagedConnection) forget(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, step := range m.topology {
+		if step.id == id {
+			m.topology = append(m.topology[:i], m.topology[i+1:]...)
+			return
+		}
+	}
+}
+
+func (m *ManagedConnection) current() liveConnection {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.conn
+}
+
+func (m *ManagedConnection) watch(conn liveConnection, closes chan *amqp.Error) {
+	err, ok := <-closes
+	if !ok || err == nil || m.IsClosed() {
+		return
+	}
+
+	slog.Warn("Connection lost", "error", err)
+	m.mu.Lock()
+	lost := append([]func(){}, m.lost...)
+	m.mu.Unlock()
+	for _, f := range lost {
+		f()
+	}
+
+	for attempt := 0; ; attempt++ {
+		time.Sleep(m.backoff.Delay(attempt))
+		if m.IsClosed() {
+			return
+		}
+
+		conn, err := m.dial()
+		if err != nil {
+			slog.Warn("Reconnect attempt failed", "attempt", attempt+1, "error", err)
+			continue
+		}
+
+		closes := conn.NotifyClose(make(chan *amqp.Error, 1))
+		if err = m.restore(conn); err != nil {
+			slog.Error("Could not restore topology", "error", err)
+			_ = conn.Close()
+			continue
+		}
+
+		slog.Info("Reconnected")
+		go m.watch(conn, closes)
+		return
+	}
+}
+
+func (m *ManagedConnection) restore(conn liveConnection) error {
+	channel, err := conn.channel()
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	topology := append([]topologyStep(nil), m.topology...)
+	m.mu.Unlock()
+
+	for _, step := range topology {
+		if err = step.declare(channel); err != nil {
+			return fmt.Errorf("%s: %w", step.id, err)
+		}
+	}
+
+	if err = channel.Close(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return amqp.ErrClosed
+	}
+	m.conn = conn
+	channels := make([]*managedChannel, 0, len(m.channels))
+	for c := range m.channels {
+		channels = append(channels, c)
+	}
+	m.mu.Unlock()
+
+	for _, c := range channels {
+		c.reopen(conn)
+	}
+
+	return nil
+}
+
+func (c *managedChannel) open(conn liveConnection) error {
+	channel, err := conn.channel()
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.qos != nil {
+		if err = c.qos(channel); err != nil {
+			_ = channel.Close()
+			return err
+		}
+	}
+
+	if c.confirm {
+		if err = channel.Confirm(false); err != nil {
+			_ = channel.Close()
+			return err
+		}
+	}
+
+	for _, consumer := range c.consumers {
+		if err = consumer.consume(channel); err != nil {
+			_ = channel.Close()
+			return err
+		}
+	}
+
+	c.ch = channel
+	go c.watch(conn, channel.NotifyClose(make(chan *amqp.Error, 1)))
+	go c.forwardConfirms(channel.NotifyPublish(make(chan amqp.Confirmation, 16)), c.published)
+	go c.forwardReturns(channel.NotifyReturn(make(chan amqp.Return, 16)))
+
+	return nil
+}
+
+func (c *managedChannel) reopen(conn liveConnection) {
+	if err := c.open(conn); err != nil {
+		slog.Error("Could not reopen channel", "error", err)
+	}
+}
+
+// watch reopens the channel after a channel-level exception.
+func (c *managedChannel) watch(conn liveConnection, closes chan *amqp.Error) {
+	err, ok := <-closes
+	if !ok || err == nil {
+		return
+	}
+
+	time.Sleep(c.conn.backoff.Initial)
+	if c.isClosed() || conn.IsClosed() || c.conn.current() != conn {
+		return
+	}
+
+	slog.Warn("Channel closed", "error", err)
+	c.reopen(conn)
+}
+
+func (c *managedChannel) isClosed() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.closed
+}
+
+func (c *managedChannel) channel() (liveChannel, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.closed {
+		return nil, amqp.ErrClosed
+	}
+
+	return c.ch, nil
+}
+
+// forwardConfirms renumbers an underlying channel's confirmations into the managed sequence.
+func (c *managedChannel) forwardConfirms(confirms chan amqp.Confirmation, offset uint64) {
+	for confirmation := range confirms {
+		confirmation.DeliveryTag += offset
+
+		c.mu.Lock()
+		c.confirmed = confirmation.DeliveryTag
+		listeners := c.confirms
+		c.mu.Unlock()
+
+		for _, listener := range listeners {
+			listener <- confirmation
+		}
+	}
+
+	c.mu.Lock()
+	first, last := c.confirmed+1, c.published
+	c.confirmed = c.published
+	listeners := c.confirms
+	c.mu.Unlock()
+
+	for tag := first; tag <= last; tag++ {
+		for _, listener := range listeners {
+			listener <- amqp.Confirmation{DeliveryTag: tag, Ack: false}
+		}
+	}
+}
+
+func (c *managedChannel) forwardReturns(returns chan amqp.Return) {
+	for returned := range returns {
+		c.mu.RLock()
+		listeners := c.returns
+		c.mu.RUnlock()
+
+		for _, listener := range listeners {
+			listener <- returned
+		}
+	}
+}
+
+func (c *managedChannel) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return amqp.ErrClosed
+	}
+
+	if err := c.ch.PublishWithContext(ctx, exchange, key, mandatory, immediate, msg); err != nil {
+		return err
+	}
+
+	if c.confirm {
+		c.published++
+	}
+
+	return nil
+}
+
+func (c *managedChannel) Confirm(noWait bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return amqp.ErrClosed
+	}
+
+	if err := c.ch.Confirm(noWait); err != nil {
+		return err
+	}
+
+	c.confirm = true
+	return nil
+}
+
+// NotifyPublish registers a listener for confirmations. Unlike on *amqp.Channel, the listener
+// outlives reconnects and is not closed when the channel is.
+func (c *managedChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.confirms = append(c.confirms, confirm)
+	return confirm
+}
+
+func (c *managedChannel) NotifyReturn(returns chan amqp.Return) chan amqp.Return {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.returns = append(c.returns, returns)
+	return returns
+}
+
+func (c *managedChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	declare := func(channel liveChannel) error {
+		return channel.ExchangeDeclare(name, kind, durable, autoDelete, internal, noWait, args)
+	}
+
+	return c.declare(fmt.Sprintf("exchange %s", name), declare)
+}
+
+func (c *managedChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	// Redeclaring a server-named queue after a reconnect would name it afresh, leaving whoever
+	// holds the old name bound to nothing.
+	if name == "" {
+		return amqp.Queue{}, ErrServerNamedQueue
+	}
+
+	channel, err := c.channel()
+	if err != nil {
+		return amqp.Queue{}, err
+	}
+
+	queue, err := channel.QueueDeclare(name, durable, autoDelete, exclusive, noWait, args)
+	if err != nil {
+		return amqp.Queue{}, err
+	}
+
+	c.record(fmt.Sprintf("queue %s", name), func(channel liveChannel) error {
+		_, err := channel.QueueDeclare(name, durable, autoDelete, exclusive, noWait, args)
+		return err
+	})
+
+	return queue, nil
+}
+
+// Passive declares only look, so unlike the others they are not replayed after a reconnect.
+func (c *managedChannel) ExchangeDeclarePassive(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	channel, err := c.channel()
+	if err != nil {
+		return err
+	}
+
+	return channel.ExchangeDeclarePassive(name, kind, durable, autoDelete, internal, noWait, args)
+}
+
+func (c *managedChannel) QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	channel, err := c.channel()
+	if err != nil {
+		return amqp.Queue{}, err
+	}
+
+	return channel.QueueDeclarePassive(name, durable, autoDelete, exclusive, noWait, args)
+}
+
+func (c *managedChannel) QueuePurge(name string, noWait bool) (int, error) {
+	channel, err := c.channel()
+	if err != nil {
+		return 0, err
+	}
+
+	return channel.QueuePurge(name, noWait)
+}
+
+func (c *managedChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	declare := func(channel liveChannel) error {
+		return channel.QueueBind(name, key, exchange, noWait, args)
+	}
+
+	return c.declare(fmt.Sprintf("binding %s -[%s]-> %s", exchange, key, name), declare)
+}
+
+func (c *managedChannel) QueueUnbind(name, key, exchange string, args amqp.Table) error {
+	channel, err := c.channel()
+	if err != nil {
+		return err
+	}
+
+	if err = channel.QueueUnbind(name, key, exchange, args); err != nil {
+		return err
+	}
+
+	// Otherwise a reconnect would bind it again.
+	id := fmt.Sprintf("binding %s -[%s]-> %s", exchange, key, name)
+	c.conn.forget(id)
+	c.mu.Lock()
+	delete(c.declared, id)
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *managedChannel) ExchangeBind(destination, key, source string, noWait bool, args amqp.Table) error {
+	declare := func(channel liveChannel) error {
+		return channel.ExchangeBind(destination, key, source, noWait, args)
+	}
+
+	return c.declare(fmt.Sprintf("binding %s -[%s]-> exchange %s", source, key, destination), declare)
+}
+
+func (c *managedChannel) declare(id string, declare func(liveChannel) error) error {
+	channel, err := c.channel()
+	if err != nil {
+		return err
+	}
+
+	if err = declare(channel); err != nil {
+		return err
+	}
+
+	c.record(id, declare)
+	return nil
+}
+
+func (c *managedChannel) record(id string, declare func(liveChannel) error) {
+	c.mu.Lock()
+	_, ok := c.declared[id]
+	c.declared[id] = struct{}{}
+	c.mu.Unlock()
+
+	if !ok {
+		c.conn.record(id, declare)
+	}
+}
+
+func forgetDeclarations(channel Channel) {
+	c, ok := channel.(*managedChannel)
+	if !ok {
+		return
+	}
+
+	c.mu.Lock()
+	declared := make([]string, 0, len(c.declared))
+	for id := range c.declared {
+		declared = append(declared, id)
+	}
+	c.declared = map[string]struct{}{}
+	c.mu.Unlock()
+
+	c.conn.release(declared)
+}
+
+func (c *managedChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	qos := func(channel liveChannel) error {
+		return channel.Qos(prefetchCount, prefetchSize, global)
+	}
+
+	channel, err := c.channel()
+	if err != nil {
+		return err
+	}
+
+	if err = qos(channel); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.qos = qos
+	c.mu.Unlock()
+
+	return nil
+}
+
+func (c *managedChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil, amqp.ErrClosed
+	}
+
+	if consumer == "" {
+		c.nextTag++
+		consumer = fmt.Sprintf("managed-%p-%d", c, c.nextTag)
+	}
+
+	mc := &managedConsumer{
+		queue:       queue,
+		tag:         consumer,
+		autoAck:     autoAck,
+		exclusive:   exclusive,
+		noLocal:     noLocal,
+		args:        args,
+		out:         make(chan amqp.Delivery),
+		generations: make(chan generation, 1),
+		done:        make(chan struct{}),
+	}
+
+	if err := mc.consume(c.ch); err != nil {
+		return nil, err
+	}
+	c.consumers[consumer] = mc
+
+	go mc.run()
+
+	return mc.out, nil
+}
+
+// Get fetches a single message. Unacknowledged gets are not carried over a reconnect; the broker
+// requeues them when the old channel dies.
+func (c *managedChannel) Get(queue string, autoAck bool) (amqp.Delivery, bool, error) {
+	channel, err := c.channel()
+	if err != nil {
+		return amqp.Delivery{}, false, err
+	}
+
+	return channel.Get(queue, autoAck)
+}
+
+func (c *managedChannel) Cancel(consumer string, noWait bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return amqp.ErrClosed
+	}
+
+	mc, ok := c.consumers[consumer]
+	if !ok {
+		return nil
+	}
+	delete(c.consumers, consumer)
+
+	if c.ch.IsClosed() {
+		mc.finish()
+		return nil
+	}
+
+	// The delivery stream ends once the broker has confirmed the cancel, draining what was prefetched.
+	mc.cancelled.Store(true)
+	return c.ch.Cancel(consumer, noWait)
+}
+
+func (c *managedChannel) Close() error {
+	c.conn.mu.Lock()
+	delete(c.conn.channels, c)
+	c.conn.mu.Unlock()
+
+	return c.shutdown()
+}
+
+func (c *managedChannel) shutdown() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return amqp.ErrClosed
+	}
+	c.closed = true
+
+	for _, consumer := range c.consumers {
+		consumer.finish()
+	}
+
+	if c.ch.IsClosed() {
+		return nil
+	}
+
+	return c.ch.Close()
+}
+
+// consume starts the consumer on channel and hands the new delivery stream to run.
+func (mc *managedConsumer) consume(channel liveChannel) error {
+	deliveries, err := channel.Consume(mc.queue, mc.tag, mc.autoAck, mc.exclusive, mc.noLocal, false, mc.args)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-mc.generations:
+	default:
+	}
+	mc.generations <- generation{deliveries: deliveries, closed: channel.NotifyClose(make(chan *amqp.Error, 1))}
+	return nil
+}
+
+func (mc *managedConsumer) run() {
+	defer close(mc.out)
+
+	for {
+		select {
+		case gen := <-mc.generations:
+			if !mc.forward(gen) || mc.cancelled.Load() {
+				return
+			}
+		case <-mc.done:
+			return
+		}
+	}
+}
+
+// forward passes on one generation's deliveries. Unacked deliveries from a channel that has died
+// are dropped, since they can no longer be acked and the broker redelivers them.
+func (mc *managedConsumer) forward(gen generation) bool {
+	closed := gen.closed
+	if mc.autoAck {
+		closed = nil
+	}
+
+	for {
+		select {
+		case delivery, ok := <-gen.deliveries:
+			if !ok {
+				return true
+			}
+			if channel, ok := delivery.Acknowledger.(interface{ IsClosed() bool }); ok && !mc.autoAck && channel.IsClosed() {
+				continue
+			}
+			select {
+			case mc.out <- delivery:
+			case <-closed:
+			case <-mc.done:
+				return false
+			}
+		case <-mc.done:
+			return false
+		}
+	}
+}
+
+func (mc *managedConsumer) finish() {
+	mc.stop.Do(func() {
+		close(mc.done)
+	})
+}
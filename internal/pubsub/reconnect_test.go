@@ -0,0 +1,140 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"testing"
+	"time"
+)
+
+var testBackoff = Backoff{Initial: time.Millisecond, Max: 10 * time.Millisecond}
+
+func newTestManaged(t *testing.T, broker *MemoryBroker) *ManagedConnection {
+	t.Helper()
+
+	managed, err := DialManagedMemory(broker, testBackoff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { managed.Close() })
+
+	return managed
+}
+
+// consumers counts a queue's consumers, or returns -1 when the queue doesn't exist.
+func consumers(broker *MemoryBroker, queue string) int {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+
+	q, ok := broker.queues[queue]
+	if !ok {
+		return -1
+	}
+
+	return len(q.consumers)
+}
+
+func TestManagedConnectionRestoresTopology(t *testing.T) {
+	broker := NewMemoryBroker()
+	managed := newTestManaged(t, broker)
+
+	channel := newTestChannel(t, managed)
+	if err := channel.ExchangeDeclare("test_exchange", amqp.ExchangeTopic, false, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan string, 10)
+	subscription, err := SubscribeMessage(context.Background(), managed, "test_exchange", "test_reconnect", "test_reconnect.*", QueueTypeTransient, func(message Message[string]) AckType {
+		received <- message.Body
+		return Ack
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscription.Close()
+
+	if err := Publish(context.Background(), channel, "test_exchange", "test_reconnect.washington", "before"); err != nil {
+		t.Fatal(err)
+	}
+	if body := receive(t, received); body != "before" {
+		t.Fatalf("got %q, want the message published before the restart", body)
+	}
+
+	// The transient exchange, queue and binding all go with the restart.
+	broker.Restart()
+
+	eventually(t, func() bool { return consumers(broker, "test_reconnect") == 1 })
+	if err := newTestChannel(t, broker).ExchangeDeclarePassive("test_exchange", amqp.ExchangeTopic, false, false, false, false, nil); err != nil {
+		t.Fatalf("exchange not redeclared: %v", err)
+	}
+
+	// The same channel publishes over the new connection, through the rebound queue, to the reattached consumer.
+	if err := Publish(context.Background(), channel, "test_exchange", "test_reconnect.washington", "after"); err != nil {
+		t.Fatal(err)
+	}
+	if body := receive(t, received); body != "after" {
+		t.Errorf("got %q, want the message published after the restart", body)
+	}
+}
+
+func TestManagedConnectionDropsDeadDeliveries(t *testing.T) {
+	broker := NewMemoryBroker()
+	managed := newTestManaged(t, broker)
+
+	channel := newTestChannel(t, managed)
+	if _, err := channel.QueueDeclare("test_redelivery", true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := channel.Qos(2, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	deliveries, err := channel.Consume("test_redelivery", "", false, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publisher := newTestChannel(t, broker)
+	for _, body := range []string{"first", "second"} {
+		err := publisher.PublishWithContext(context.Background(), "", "test_redelivery", false, false, amqp.Publishing{
+			DeliveryMode: amqp.Persistent,
+			Body:         []byte(body),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stale := receive(t, deliveries)
+	// Give the consumer time to pick up the second delivery, which it then holds when the channel dies.
+	time.Sleep(20 * time.Millisecond)
+	broker.Restart()
+	eventually(t, func() bool { return consumers(broker, "test_redelivery") == 1 })
+
+	if err := stale.Ack(false); err == nil {
+		t.Error("acked a delivery from a channel that died")
+	}
+
+	// Only redeliveries on the new channel come through, and they can be acked.
+	for range 2 {
+		delivery := receive(t, deliveries)
+		if !delivery.Redelivered {
+			t.Errorf("got %q from the dead channel", delivery.Body)
+		}
+		if err := delivery.Ack(false); err != nil {
+			t.Errorf("could not ack %q: %v", delivery.Body, err)
+		}
+	}
+	select {
+	case delivery := <-deliveries:
+		t.Errorf("got %q, want nothing after both redeliveries", delivery.Body)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestManagedConnectionRejectsServerNamedQueues(t *testing.T) {
+	channel := newTestChannel(t, newTestManaged(t, NewMemoryBroker()))
+
+	if _, err := channel.QueueDeclare("", false, true, true, false, nil); !errors.Is(err, ErrServerNamedQueue) {
+		t.Errorf("got %v, want ErrServerNamedQueue", err)
+	}
+}
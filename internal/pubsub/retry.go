@@ -0,0 +1,131 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+const HeaderRetryCount = "x-retry-count"
+
+type RetryPolicy struct {
+	Backoff     Backoff
+	MaxAttempts int
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	Backoff:     Backoff{Initial: time.Second, Max: 30 * time.Second},
+	MaxAttempts: 10,
+}
+
+// retrier parks RetryLater deliveries in per-delay queues that dead-letter back to the origin.
+type retrier struct {
+	channel Channel
+	queue   string
+	durable bool
+	policy  RetryPolicy
+}
+
+func newRetrier(channel Channel, queue string, durable bool, policy RetryPolicy) *retrier {
+	return &retrier{
+		channel: channel,
+		queue:   queue,
+		durable: durable,
+		policy:  policy,
+	}
+}
+
+func (r *retrier) retry(ctx context.Context, delivery amqp.Delivery) error {
+	attempt, _ := tableInt(delivery.Headers, HeaderRetryCount)
+	if int(attempt) >= r.policy.MaxAttempts {
+		slog.WarnContext(ctx, "Giving up on message", "queue", r.queue, "message_id", delivery.MessageId, "attempts", attempt)
+		return delivery.Nack(false, false)
+	}
+
+	delay := r.policy.Backoff.Delay(int(attempt))
+	retryQueue, err := r.declare(delay)
+	if err != nil {
+		return err
+	}
+
+	headers := amqp.Table{}
+	for k, v := range delivery.Headers {
+		headers[k] = v
+	}
+	headers[HeaderRetryCount] = attempt + 1
+	if _, ok := headers[HeaderOriginalRoutingKey]; !ok {
+		headers[HeaderOriginalExchange] = delivery.Exchange
+		headers[HeaderOriginalRoutingKey] = delivery.RoutingKey
+	}
+
+	err = r.channel.PublishWithContext(ctx, "", retryQueue, false, false, republishing(delivery, headers))
+	if err != nil {
+		return err
+	}
+
+	return delivery.Ack(false)
+}
+
+// declare runs before every retry, since redeclaring keeps the queue from expiring.
+func (r *retrier) declare(delay time.Duration) (string, error) {
+	name := fmt.Sprintf("%s.retry.%d", r.queue, delay.Milliseconds())
+
+	_, err := r.channel.QueueDeclare(name, r.durable, false, false, false, amqp.Table{
+		"x-message-ttl":             delay.Milliseconds(),
+		"x-expires":                 (delay + time.Minute).Milliseconds(),
+		"x-dead-letter-exchange":    "",
+		"x-dead-letter-routing-key": r.queue,
+	})
+
+	return name, err
+}
+
+// trustRoute drops the original-route headers unless the delivery came back to queue from one of its
+// retry queues. Any publisher can set them, and handlers check senders against the routing key.
+func trustRoute(delivery amqp.Delivery, queue string) amqp.Delivery {
+	_, hasExchange := delivery.Headers[HeaderOriginalExchange]
+	_, hasKey := delivery.Headers[HeaderOriginalRoutingKey]
+	if !hasExchange && !hasKey || retried(delivery, queue) {
+		return delivery
+	}
+
+	// The table may be shared with copies routed to other queues, so strip a copy.
+	headers := amqp.Table{}
+	for k, v := range delivery.Headers {
+		if k != HeaderOriginalExchange && k != HeaderOriginalRoutingKey {
+			headers[k] = v
+		}
+	}
+	delivery.Headers = headers
+
+	return delivery
+}
+
+// retried reports whether the broker dead-lettered the delivery to queue as it expired from a retry queue.
+func retried(delivery amqp.Delivery, queue string) bool {
+	if delivery.Exchange != "" || delivery.RoutingKey != queue {
+		return false
+	}
+
+	deaths, _ := delivery.Headers["x-death"].([]interface{})
+	if len(deaths) == 0 {
+		return false
+	}
+	// x-death is newest first.
+	death, _ := deaths[0].(amqp.Table)
+	from, _ := death["queue"].(string)
+	reason, _ := death["reason"].(string)
+
+	return reason == "expired" && strings.HasPrefix(from, queue+".retry.")
+}
+
+func originalRoutingKey(delivery amqp.Delivery) string {
+	if key, ok := delivery.Headers[HeaderOriginalRoutingKey].(string); ok {
+		return key
+	}
+
+	return delivery.RoutingKey
+}
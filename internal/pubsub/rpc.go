@@ -0,0 +1,260 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/codec"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const directReplyTo = "amq.rabbitmq.reply-to"
+
+const HeaderRPCError = "x-rpc-error"
+
+var ErrRPCClientClosed = errors.New("rpc client is closed")
+
+// RemoteError is an error returned by a Serve handler, carried back to the caller.
+type RemoteError struct {
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return "remote: " + e.Message
+}
+
+// RPCClient makes request/reply calls over direct reply-to. It owns one channel with a reply
+// consumer and matches replies to calls by correlation ID.
+type RPCClient struct {
+	channel Channel
+	timeout time.Duration
+
+	mu      sync.Mutex
+	pending map[string]chan rpcReply
+	err     error
+}
+
+type rpcReply struct {
+	delivery amqp.Delivery
+	err      error
+}
+
+// NewRPCClient opens a channel for calls. Calls give up after timeout unless their context ends first.
+func NewRPCClient(broker Broker, timeout time.Duration) (*RPCClient, error) {
+	channel, err := broker.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	replies, err := channel.Consume(directReplyTo, "", true, false, false, false, nil)
+	if err != nil {
+		channel.Close()
+		return nil, err
+	}
+	returns := channel.NotifyReturn(make(chan amqp.Return, 1))
+
+	client := &RPCClient{
+		channel: channel,
+		timeout: timeout,
+		pending: map[string]chan rpcReply{},
+	}
+	go client.run(replies, returns)
+
+	return client, nil
+}
+
+func (c *RPCClient) run(replies <-chan amqp.Delivery, returns <-chan amqp.Return) {
+	for {
+		select {
+		case delivery, ok := <-replies:
+			if !ok {
+				c.closeWith(ErrConsumerClosed)
+				return
+			}
+			c.resolve(delivery.CorrelationId, rpcReply{delivery: delivery})
+		case r, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			c.resolve(r.CorrelationId, rpcReply{err: &UnroutableError{
+				Exchange:   r.Exchange,
+				RoutingKey: r.RoutingKey,
+				ReplyCode:  r.ReplyCode,
+				ReplyText:  r.ReplyText,
+			}})
+		}
+	}
+}
+
+func (c *RPCClient) register(correlationID string) (<-chan rpcReply, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	reply := make(chan rpcReply, 1)
+	c.pending[correlationID] = reply
+	return reply, nil
+}
+
+func (c *RPCClient) forget(correlationID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.pending, correlationID)
+}
+
+// resolve hands a reply to the call waiting for it. Replies to calls that already gave up are dropped.
+func (c *RPCClient) resolve(correlationID string, reply rpcReply) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if pending, ok := c.pending[correlationID]; ok {
+		delete(c.pending, correlationID)
+		pending <- reply
+	}
+}
+
+func (c *RPCClient) closeWith(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return
+	}
+
+	c.err = err
+	for correlationID, pending := range c.pending {
+		delete(c.pending, correlationID)
+		pending <- rpcReply{err: err}
+	}
+}
+
+// Close fails any calls still waiting and closes the client's channel.
+func (c *RPCClient) Close() error {
+	c.closeWith(ErrRPCClientClosed)
+	return c.channel.Close()
+}
+
+// Call publishes req as a request and waits for the reply, decoded with the codec the server
+// answered in. Requests nobody is bound to receive fail with ErrUnroutable, and errors returned by
+// the server's handler come back as *RemoteError.
+func Call[Req, Resp any](ctx context.Context, client *RPCClient, exchange, key string, req Req, opts ...PublishOption) (Resp, error) {
+	var resp Resp
+	options := newPublishOptions(opts)
+
+	body, err := options.codec.Marshal(req)
+	if err != nil {
+		return resp, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, client.timeout)
+	defer cancel()
+
+	correlationID := newMessageID()
+	replies, err := client.register(correlationID)
+	if err != nil {
+		return resp, err
+	}
+	defer client.forget(correlationID)
+
+	publishing := options.publishing(body)
+	publishing.CorrelationId = correlationID
+	publishing.ReplyTo = directReplyTo
+	if deadline, ok := ctx.Deadline(); ok {
+		// Nobody will be waiting for the answer once the call times out, so don't let it be served late.
+		publishing.Expiration = strconv.FormatInt(max(time.Until(deadline).Milliseconds(), 1), 10)
+	}
+
+	span := startPublishSpan(ctx, "call "+key, exchange, key, &publishing)
+	defer span.End()
+
+	if err = client.channel.PublishWithContext(ctx, exchange, key, true, false, publishing); err != nil {
+		span.SetError(err)
+		return resp, err
+	}
+
+	var reply rpcReply
+	select {
+	case reply = <-replies:
+	case <-ctx.Done():
+		span.SetError(ctx.Err())
+		return resp, fmt.Errorf("call %s: %w", key, ctx.Err())
+	}
+	if reply.err != nil {
+		span.SetError(reply.err)
+		return resp, reply.err
+	}
+
+	if message, ok := reply.delivery.Headers[HeaderRPCError].(string); ok {
+		err := &RemoteError{Message: message}
+		span.SetError(err)
+		return resp, err
+	}
+
+	decoder, err := codec.Lookup(reply.delivery.ContentType)
+	if err != nil {
+		return resp, err
+	}
+
+	return resp, decoder.Unmarshal(reply.delivery.Body, &resp)
+}
+
+// Serve answers requests made with Call. Requests are decoded and handled like SubscribeMessage
+// deliveries, and the handler's response or error is sent back to the caller in the request's codec.
+func Serve[Req, Resp any](ctx context.Context, broker Broker, exchange, queueName, key string, simpleQueueType int, handler func(Message[Req]) (Resp, error), opts ...SubscribeOption) (*Subscription, error) {
+	replies, err := broker.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	subscription, err := SubscribeMessage(ctx, broker, exchange, queueName, key, simpleQueueType, func(request Message[Req]) AckType {
+		if request.ReplyTo == "" {
+			slog.WarnContext(request.Context(), "Discarding request without a reply-to address", "queue", queueName, "message_id", request.MessageID)
+			return NackDiscard
+		}
+
+		encoder, err := codec.Lookup(request.ContentType)
+		if err != nil {
+			encoder = codec.JSON
+		}
+
+		var reply amqp.Publishing
+		resp, err := handler(request)
+		if err == nil {
+			var body []byte
+			if body, err = encoder.Marshal(resp); err == nil {
+				reply = publishOptions{codec: encoder, messageID: newMessageID()}.publishing(body)
+			}
+		}
+		if err != nil {
+			reply = amqp.Publishing{Headers: amqp.Table{HeaderRPCError: err.Error()}}
+		}
+		reply.CorrelationId = request.CorrelationID
+		injectTrace(request.Context(), &reply)
+
+		if err := replies.PublishWithContext(context.WithoutCancel(ctx), "", request.ReplyTo, false, false, reply); err != nil {
+			slog.ErrorContext(request.Context(), "Could not reply to request", "queue", queueName, "message_id", request.MessageID, "error", err)
+		}
+
+		return Ack
+	}, opts...)
+	if err != nil {
+		replies.Close()
+		return nil, err
+	}
+
+	go func() {
+		<-subscription.Done()
+		replies.Close()
+	}()
+
+	return subscription, nil
+}
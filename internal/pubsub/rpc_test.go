@@ -0,0 +1,199 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/codec"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestRPCClient(t *testing.T, broker Broker, timeout time.Duration) *RPCClient {
+	t.Helper()
+
+	client, err := NewRPCClient(broker, timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	return client
+}
+
+func serveTest(t *testing.T, broker Broker, handler func(Message[testMove]) (testMove, error)) {
+	t.Helper()
+
+	subscription, err := Serve(context.Background(), broker, routing.ExchangePerilDirect, "test_rpc", "test_rpc", QueueTypeTransient, handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { subscription.Close() })
+}
+
+func TestCallServe(t *testing.T) {
+	for _, c := range []codec.Codec{codec.JSON, codec.MsgPack} {
+		t.Run(c.ContentType(), func(t *testing.T) {
+			broker := newTestBroker(t)
+			serveTest(t, broker, func(request Message[testMove]) (testMove, error) {
+				if request.ContentType != c.ContentType() {
+					t.Errorf("request content type %q, want %q", request.ContentType, c.ContentType())
+				}
+				return testMove{Player: strings.ToUpper(request.Body.Player), Units: append(request.Body.Units, 3)}, nil
+			})
+
+			resp, err := Call[testMove, testMove](context.Background(), newTestRPCClient(t, broker, testTimeout), routing.ExchangePerilDirect, "test_rpc", testMove{Player: "washington", Units: []int{1, 2}}, WithCodec(c))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Player != "WASHINGTON" || len(resp.Units) != 3 || resp.Units[2] != 3 {
+				t.Errorf("got %+v, want the handler's response", resp)
+			}
+		})
+	}
+}
+
+func TestCallErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		handler func(context.Context, Message[testMove]) (testMove, error)
+		ctx     func() (context.Context, context.CancelFunc)
+		want    error
+	}{
+		{
+			name: "remote error",
+			key:  "test_rpc",
+			handler: func(context.Context, Message[testMove]) (testMove, error) {
+				return testMove{}, errors.New("no such player")
+			},
+			want: &RemoteError{},
+		},
+		{
+			name: "nobody serving",
+			key:  "nobody_serves",
+			want: ErrUnroutable,
+		},
+		{
+			name: "timeout",
+			key:  "test_rpc",
+			handler: func(ctx context.Context, _ Message[testMove]) (testMove, error) {
+				<-ctx.Done()
+				return testMove{}, nil
+			},
+			want: context.DeadlineExceeded,
+		},
+		{
+			name: "caller deadline",
+			key:  "test_rpc",
+			handler: func(ctx context.Context, _ Message[testMove]) (testMove, error) {
+				<-ctx.Done()
+				return testMove{}, nil
+			},
+			ctx: func() (context.Context, context.CancelFunc) {
+				return context.WithTimeout(context.Background(), 20*time.Millisecond)
+			},
+			want: context.DeadlineExceeded,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := newTestBroker(t)
+			// Handlers that hang are let go once the test is over.
+			done, release := context.WithCancel(context.Background())
+			defer release()
+			if tt.handler != nil {
+				serveTest(t, broker, func(request Message[testMove]) (testMove, error) {
+					return tt.handler(done, request)
+				})
+			}
+
+			timeout := testTimeout
+			if tt.ctx == nil {
+				timeout = 50 * time.Millisecond
+				tt.ctx = func() (context.Context, context.CancelFunc) { return context.WithCancel(context.Background()) }
+			}
+			ctx, cancel := tt.ctx()
+			defer cancel()
+
+			_, err := Call[testMove, testMove](ctx, newTestRPCClient(t, broker, timeout), routing.ExchangePerilDirect, tt.key, testMove{Player: "washington"})
+			var remote *RemoteError
+			if _, ok := tt.want.(*RemoteError); ok {
+				if !errors.As(err, &remote) || remote.Message != "no such player" {
+					t.Errorf("got %v, want the handler's error", err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCallCancel(t *testing.T) {
+	broker := newTestBroker(t)
+	started := make(chan struct{}, 1)
+	done, release := context.WithCancel(context.Background())
+	defer release()
+	serveTest(t, broker, func(Message[testMove]) (testMove, error) {
+		started <- struct{}{}
+		<-done.Done()
+		return testMove{}, nil
+	})
+
+	client := newTestRPCClient(t, broker, testTimeout)
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		_, err := Call[testMove, testMove](ctx, client, routing.ExchangePerilDirect, "test_rpc", testMove{})
+		errs <- err
+	}()
+
+	receive(t, started)
+	cancel()
+	if err := receive(t, errs); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+}
+
+// TestCallCorrelation answers every request twice, first under the wrong correlation ID.
+func TestCallCorrelation(t *testing.T) {
+	broker := newTestBroker(t)
+	channel := newTestChannel(t, broker)
+	if _, _, err := DeclareAndBind(broker, routing.ExchangePerilDirect, "test_rpc", "test_rpc", QueueTypeDurable); err != nil {
+		t.Fatal(err)
+	}
+	requests, err := channel.Consume("test_rpc", "", true, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for request := range requests {
+			for _, reply := range []struct{ correlationID, player string }{
+				{"someone-else", "impostor"},
+				{request.CorrelationId, "washington"},
+			} {
+				channel.PublishWithContext(context.Background(), "", request.ReplyTo, false, false, amqp.Publishing{
+					ContentType:   codec.JSON.ContentType(),
+					CorrelationId: reply.correlationID,
+					Body:          []byte(`{"Player":"` + reply.player + `"}`),
+				})
+			}
+		}
+	}()
+
+	client := newTestRPCClient(t, broker, testTimeout)
+	for range 3 {
+		resp, err := Call[testMove, testMove](context.Background(), client, routing.ExchangePerilDirect, "test_rpc", testMove{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Player != "washington" {
+			t.Errorf("got the reply meant for %q", resp.Player)
+		}
+	}
+}
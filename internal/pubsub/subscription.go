@@ -0,0 +1,50 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+var ErrConsumerClosed = errors.New("delivery channel closed by the broker")
+
+var consumerSequence atomic.Uint64
+
+// Subscription is a running consumer. Cancelling the context passed to Subscribe* or calling Close
+// cancels the consumer tag, lets in-flight deliveries finish and be acknowledged, then closes the channel.
+type Subscription struct {
+	Queue       string
+	ConsumerTag string
+
+	cancel     context.CancelFunc
+	done       chan struct{}
+	err        error
+	duplicates atomic.Uint64
+}
+
+func newConsumerTag(queueName string) string {
+	return fmt.Sprintf("%s-%d", queueName, consumerSequence.Add(1))
+}
+
+// Close stops the consumer and waits for it to drain, returning its terminal error.
+func (s *Subscription) Close() error {
+	s.cancel()
+	return s.Wait()
+}
+
+// Wait blocks until the consumer has stopped and returns its terminal error, if any.
+func (s *Subscription) Wait() error {
+	<-s.done
+	return s.err
+}
+
+// Done is closed once the consumer has stopped.
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+// Duplicates is how many deliveries WithDedupe has dropped so far.
+func (s *Subscription) Duplicates() uint64 {
+	return s.duplicates.Load()
+}
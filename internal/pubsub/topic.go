@@ -0,0 +1,59 @@
+package pubsub
+
+import (
+	"context"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// BoundTopic is a routing.Topic with the methods that need a broker.
+type BoundTopic[T any] struct {
+	routing.Topic[T]
+}
+
+// Bind lets topic publish and subscribe.
+func Bind[T any](topic routing.Topic[T]) BoundTopic[T] {
+	return BoundTopic[T]{topic}
+}
+
+// Publish publishes value with the topic's codec, under the routing key for params.
+func (t BoundTopic[T]) Publish(ctx context.Context, ch Publisher, params []string, value T, opts ...PublishOption) error {
+	key, err := t.Key(params...)
+	if err != nil {
+		return err
+	}
+
+	return Publish(ctx, ch, t.Exchange, key, value, append([]PublishOption{WithCodec(t.Codec)}, opts...)...)
+}
+
+// PublishBatch is PublishBatch for a topic.
+func (t BoundTopic[T]) PublishBatch(ctx context.Context, ch Publisher, params []string, values []T, opts ...PublishOption) error {
+	key, err := t.Key(params...)
+	if err != nil {
+		return err
+	}
+
+	return PublishBatch(ctx, ch, t.Exchange, key, values, append([]PublishOption{WithCodec(t.Codec)}, opts...)...)
+}
+
+// Subscribe consumes the topic from the queue for params, declaring and binding the queue as the
+// topic describes. The topic's codec decodes deliveries without a content type.
+func (t BoundTopic[T]) Subscribe(ctx context.Context, broker Broker, params []string, handler func(T) AckType, opts ...SubscribeOption) (*Subscription, error) {
+	return t.SubscribeMessage(ctx, broker, params, func(message Message[T]) AckType {
+		return handler(message.Body)
+	}, opts...)
+}
+
+// SubscribeMessage is Subscribe for handlers that also need the delivery's metadata.
+func (t BoundTopic[T]) SubscribeMessage(ctx context.Context, broker Broker, params []string, handler func(Message[T]) AckType, opts ...SubscribeOption) (*Subscription, error) {
+	queueName, err := t.QueueName(params...)
+	if err != nil {
+		return nil, err
+	}
+
+	queueType := QueueTypeTransient
+	if t.Durable {
+		queueType = QueueTypeDurable
+	}
+
+	return SubscribeMessage(ctx, broker, t.Exchange, queueName, t.Pattern, queueType, handler, append([]SubscribeOption{WithDefaultCodec(t.Codec)}, opts...)...)
+}
@@ -0,0 +1,170 @@
+package pubsub
+
+import (
+	"errors"
+	"fmt"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Drift is one way the broker differs from a topology spec.
+type Drift struct {
+	Kind    string
+	Name    string
+	Problem string
+}
+
+func (d Drift) String() string {
+	return fmt.Sprintf("%s %s: %s", d.Kind, d.Name, d.Problem)
+}
+
+// ApplyTopology declares every exchange, queue and binding in the topology. Declaring is
+// idempotent, so it is safe to run on every start; it fails if something already exists with
+// different settings.
+func ApplyTopology(broker Broker, topology routing.Topology) error {
+	if err := topology.Validate(); err != nil {
+		return err
+	}
+
+	channel, err := broker.Channel()
+	if err != nil {
+		return err
+	}
+	defer channel.Close()
+
+	for _, exchange := range topology.Exchanges {
+		if err := channel.ExchangeDeclare(exchange.Name, exchange.Kind, exchange.Durable, exchange.AutoDelete, exchange.Internal, false, amqp.Table(exchange.Arguments)); err != nil {
+			return fmt.Errorf("declaring exchange %s: %w", exchange.Name, err)
+		}
+	}
+
+	for _, queue := range topology.Queues {
+		if _, err := channel.QueueDeclare(queue.Name, queue.Durable, queue.AutoDelete, queue.Exclusive, false, amqp.Table(queue.Args())); err != nil {
+			return fmt.Errorf("declaring queue %s: %w", queue.Name, err)
+		}
+	}
+
+	for _, binding := range topology.Bindings {
+		if err := channel.QueueBind(binding.Queue, binding.Key, binding.Exchange, false, amqp.Table(binding.Arguments)); err != nil {
+			return fmt.Errorf("binding %s to %s with key %q: %w", binding.Queue, binding.Exchange, binding.Key, err)
+		}
+	}
+
+	for _, binding := range topology.ExchangeBindings {
+		if err := channel.ExchangeBind(binding.Destination, binding.Key, binding.Source, false, amqp.Table(binding.Arguments)); err != nil {
+			return fmt.Errorf("binding exchange %s to %s with key %q: %w", binding.Destination, binding.Source, binding.Key, err)
+		}
+	}
+
+	return nil
+}
+
+// RemoveBindings unbinds queues that a topology no longer wants bound, such as when switching to
+// one that routes the same messages elsewhere. Bindings that don't exist are ignored.
+func RemoveBindings(broker Broker, bindings ...routing.BindingSpec) error {
+	channel, err := broker.Channel()
+	if err != nil {
+		return err
+	}
+	defer channel.Close()
+
+	for _, binding := range bindings {
+		if err := channel.QueueUnbind(binding.Queue, binding.Key, binding.Exchange, amqp.Table(binding.Arguments)); err != nil {
+			return fmt.Errorf("unbinding %s from %s with key %q: %w", binding.Queue, binding.Exchange, binding.Key, err)
+		}
+	}
+
+	return nil
+}
+
+// VerifyTopology compares the broker against the topology without creating anything that is
+// missing. AMQP cannot list bindings, so bindings are only checked for ends that don't exist.
+func VerifyTopology(broker Broker, topology routing.Topology) ([]Drift, error) {
+	if err := topology.Validate(); err != nil {
+		return nil, err
+	}
+
+	var drift []Drift
+	missing := map[string]bool{}
+
+	for _, exchange := range topology.Exchanges {
+		problem, err := probeEntity(broker, func(channel Channel) error {
+			return channel.ExchangeDeclarePassive(exchange.Name, exchange.Kind, exchange.Durable, exchange.AutoDelete, exchange.Internal, false, amqp.Table(exchange.Arguments))
+		}, func(channel Channel) error {
+			return channel.ExchangeDeclare(exchange.Name, exchange.Kind, exchange.Durable, exchange.AutoDelete, exchange.Internal, false, amqp.Table(exchange.Arguments))
+		})
+		if err != nil {
+			return nil, err
+		}
+		if problem != "" {
+			drift = append(drift, Drift{Kind: "exchange", Name: exchange.Name, Problem: problem})
+			missing["exchange "+exchange.Name] = problem == problemMissing
+		}
+	}
+
+	for _, queue := range topology.Queues {
+		problem, err := probeEntity(broker, func(channel Channel) error {
+			_, err := channel.QueueDeclarePassive(queue.Name, queue.Durable, queue.AutoDelete, queue.Exclusive, false, amqp.Table(queue.Args()))
+			return err
+		}, func(channel Channel) error {
+			_, err := channel.QueueDeclare(queue.Name, queue.Durable, queue.AutoDelete, queue.Exclusive, false, amqp.Table(queue.Args()))
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		if problem != "" {
+			drift = append(drift, Drift{Kind: "queue", Name: queue.Name, Problem: problem})
+			missing["queue "+queue.Name] = problem == problemMissing
+		}
+	}
+
+	for _, binding := range topology.Bindings {
+		name := fmt.Sprintf("%s -[%s]-> %s", binding.Exchange, binding.Key, binding.Queue)
+		if missing["exchange "+binding.Exchange] {
+			drift = append(drift, Drift{Kind: "binding", Name: name, Problem: "exchange is missing"})
+		}
+		if missing["queue "+binding.Queue] {
+			drift = append(drift, Drift{Kind: "binding", Name: name, Problem: "queue is missing"})
+		}
+	}
+
+	for _, binding := range topology.ExchangeBindings {
+		name := fmt.Sprintf("%s -[%s]-> exchange %s", binding.Source, binding.Key, binding.Destination)
+		for _, exchange := range []string{binding.Source, binding.Destination} {
+			if missing["exchange "+exchange] {
+				drift = append(drift, Drift{Kind: "binding", Name: name, Problem: fmt.Sprintf("exchange %s is missing", exchange)})
+			}
+		}
+	}
+
+	return drift, nil
+}
+
+const problemMissing = "missing"
+
+// probeEntity runs each check on its own channel, since a refused declare closes it.
+func probeEntity(broker Broker, exists, matches func(Channel) error) (string, error) {
+	for _, check := range []func(Channel) error{exists, matches} {
+		channel, err := broker.Channel()
+		if err != nil {
+			return "", err
+		}
+
+		err = check(channel)
+		closeChannel(channel)
+
+		var amqpErr *amqp.Error
+		switch {
+		case err == nil:
+		case errors.As(err, &amqpErr) && amqpErr.Code == amqp.NotFound:
+			return problemMissing, nil
+		case errors.As(err, &amqpErr) && (amqpErr.Code == amqp.PreconditionFailed || amqpErr.Code == amqp.ResourceLocked):
+			return amqpErr.Reason, nil
+		default:
+			return "", err
+		}
+	}
+
+	return "", nil
+}
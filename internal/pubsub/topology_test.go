@@ -0,0 +1,65 @@
+package pubsub
+
+import (
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	"testing"
+)
+
+func TestApplyAndVerifyTopology(t *testing.T) {
+	broker := NewMemoryBroker()
+
+	drift, err := VerifyTopology(broker, routing.ShardedPerilTopology)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every exchange and queue is missing, and so every binding has a missing end.
+	topology := routing.ShardedPerilTopology
+	if want := len(topology.Exchanges) + len(topology.Queues); len(drift) < want {
+		t.Errorf("got %d drifts on an empty broker, want at least %d: %v", len(drift), want, drift)
+	}
+
+	if err := ApplyTopology(broker, topology); err != nil {
+		t.Fatal(err)
+	}
+	// Applying is idempotent.
+	if err := ApplyTopology(broker, topology); err != nil {
+		t.Fatal(err)
+	}
+
+	drift, err = VerifyTopology(broker, topology)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drift) != 0 {
+		t.Errorf("got drift %v after applying the topology", drift)
+	}
+}
+
+func TestVerifyTopologyReportsMismatches(t *testing.T) {
+	broker := newTestBroker(t)
+
+	// The game log queue declared without its dead-letter exchange.
+	topology := routing.Topology{
+		Queues: []routing.QueueSpec{{Name: routing.GameLogSlug, Durable: true}},
+	}
+	drift, err := VerifyTopology(broker, topology)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drift) != 1 || drift[0].Kind != "queue" || drift[0].Name != routing.GameLogSlug || drift[0].Problem == problemMissing {
+		t.Errorf("got drift %v, want a mismatch on the %s queue", drift, routing.GameLogSlug)
+	}
+
+	if err := ApplyTopology(broker, topology); err == nil {
+		t.Error("applying a topology that conflicts with the broker succeeded")
+	}
+}
+
+func TestApplyTopologyRejectsInvalid(t *testing.T) {
+	topology := routing.Topology{
+		Bindings: []routing.BindingSpec{{Exchange: routing.ExchangePerilTopic, Queue: "nowhere", Key: "#"}},
+	}
+	if err := ApplyTopology(NewMemoryBroker(), topology); err == nil {
+		t.Error("applied a binding to a queue the topology doesn't declare")
+	}
+}
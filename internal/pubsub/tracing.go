@@ -0,0 +1,52 @@
+package pubsub
+
+import (
+	"context"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/tracing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func startPublishSpan(ctx context.Context, name, exchange, key string, publishings ...*amqp.Publishing) *tracing.Span {
+	ctx, span := tracing.Start(ctx, name)
+	span.SetAttribute("exchange", exchange)
+	span.SetAttribute("routing_key", key)
+	if len(publishings) == 1 {
+		span.SetAttribute("message_id", publishings[0].MessageId)
+	}
+
+	for _, publishing := range publishings {
+		injectTrace(ctx, publishing)
+	}
+
+	return span
+}
+
+// injectTrace copies the headers, which callers may share between messages.
+func injectTrace(ctx context.Context, publishing *amqp.Publishing) {
+	sc, ok := tracing.FromContext(ctx)
+	if !ok {
+		return
+	}
+
+	headers := amqp.Table{}
+	for k, v := range publishing.Headers {
+		headers[k] = v
+	}
+	headers[tracing.TraceparentHeader] = sc.Traceparent()
+	publishing.Headers = headers
+}
+
+func startConsumeSpan(ctx context.Context, queue string, delivery amqp.Delivery) (context.Context, *tracing.Span) {
+	if traceparent, ok := delivery.Headers[tracing.TraceparentHeader].(string); ok {
+		if parent, err := tracing.ParseTraceparent(traceparent); err == nil {
+			ctx = tracing.ContextWithSpanContext(ctx, parent)
+		}
+	}
+
+	ctx, span := tracing.Start(ctx, "handle "+queue)
+	span.SetAttribute("queue", queue)
+	span.SetAttribute("routing_key", originalRoutingKey(delivery))
+	span.SetAttribute("message_id", delivery.MessageId)
+
+	return ctx, span
+}
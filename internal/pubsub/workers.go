@@ -0,0 +1,82 @@
+package pubsub
+
+import (
+	amqp "github.com/rabbitmq/amqp091-go"
+	"hash/fnv"
+	"sync"
+)
+
+// workerPool runs a handler on several goroutines. When ordered, each routing key keeps to one worker.
+type workerPool struct {
+	queues  []chan amqp.Delivery
+	ordered bool
+	wg      sync.WaitGroup
+
+	failOnce sync.Once
+	failed   chan struct{}
+	err      error
+}
+
+func newWorkerPool(size, buffer int, ordered bool, handle func(amqp.Delivery) error) *workerPool {
+	if size < 1 {
+		size = 1
+	}
+
+	pool := &workerPool{ordered: ordered, failed: make(chan struct{})}
+	if ordered {
+		pool.queues = make([]chan amqp.Delivery, size)
+		for i := range pool.queues {
+			pool.queues[i] = make(chan amqp.Delivery, buffer)
+		}
+	} else {
+		pool.queues = []chan amqp.Delivery{make(chan amqp.Delivery, buffer)}
+	}
+
+	for i := 0; i < size; i++ {
+		queue := pool.queues[i%len(pool.queues)]
+
+		pool.wg.Add(1)
+		go func() {
+			defer pool.wg.Done()
+
+			for delivery := range queue {
+				if err := handle(delivery); err != nil {
+					pool.fail(err)
+				}
+			}
+		}()
+	}
+
+	return pool
+}
+
+// dispatch drops deliveries once a handler has failed; they return when the channel closes.
+func (p *workerPool) dispatch(delivery amqp.Delivery) {
+	queue := p.queues[0]
+	if p.ordered {
+		hash := fnv.New32a()
+		hash.Write([]byte(originalRoutingKey(delivery)))
+		queue = p.queues[hash.Sum32()%uint32(len(p.queues))]
+	}
+
+	select {
+	case queue <- delivery:
+	case <-p.failed:
+	}
+}
+
+func (p *workerPool) fail(err error) {
+	p.failOnce.Do(func() {
+		p.err = err
+		close(p.failed)
+	})
+}
+
+func (p *workerPool) stop() error {
+	for _, queue := range p.queues {
+		close(queue)
+	}
+	p.wg.Wait()
+
+	return p.err
+}
@@ -0,0 +1,94 @@
+package routing
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// MaxKeyLength is the longest routing key AMQP allows, in bytes.
+const MaxKeyLength = 255
+
+// MaxUsernameLength leaves room in a key for the prefix in front of the username.
+const MaxUsernameLength = 64
+
+var (
+	ErrInvalidSegment = errors.New("invalid routing key segment")
+	ErrKeyMismatch    = errors.New("routing key does not match pattern")
+)
+
+// ValidateSegment checks that s can stand as one word of a routing key: it isn't empty, and holds
+// no `.` to split it, no `*` or `#` for bindings to mistake for wildcards, and no spaces or control
+// characters.
+func ValidateSegment(s string) error {
+	if s == "" {
+		return fmt.Errorf("%w: empty", ErrInvalidSegment)
+	}
+
+	for _, r := range s {
+		switch {
+		case r == '.' || r == '*' || r == '#':
+			return fmt.Errorf("%w: %q contains %q", ErrInvalidSegment, s, r)
+		case unicode.IsSpace(r) || unicode.IsControl(r):
+			return fmt.Errorf("%w: %q contains whitespace or control characters", ErrInvalidSegment, s)
+		}
+	}
+
+	return nil
+}
+
+// ValidateUsername checks that a username is safe to put in routing keys and queue names.
+func ValidateUsername(username string) error {
+	if len(username) > MaxUsernameLength {
+		return fmt.Errorf("%w: usernames are at most %d bytes", ErrInvalidSegment, MaxUsernameLength)
+	}
+
+	return ValidateSegment(username)
+}
+
+// BuildKey joins segments into a routing key, rejecting any that ValidateSegment does.
+func BuildKey(segments ...string) (string, error) {
+	if len(segments) == 0 {
+		return "", fmt.Errorf("%w: no segments", ErrInvalidSegment)
+	}
+	for _, segment := range segments {
+		if err := ValidateSegment(segment); err != nil {
+			return "", err
+		}
+	}
+
+	key := strings.Join(segments, ".")
+	if len(key) > MaxKeyLength {
+		return "", fmt.Errorf("routing key %q is longer than %d bytes", key, MaxKeyLength)
+	}
+
+	return key, nil
+}
+
+// ParseKey matches key against a pattern whose `*` words are parameters, such as army_moves.*, and
+// returns the words of key in their places. Every word of key must be a valid segment.
+func ParseKey(pattern, key string) ([]string, error) {
+	patternWords := strings.Split(pattern, ".")
+	words := strings.Split(key, ".")
+	if len(words) != len(patternWords) {
+		return nil, fmt.Errorf("%w: %q against %q", ErrKeyMismatch, key, pattern)
+	}
+
+	var params []string
+	for i, word := range words {
+		if err := ValidateSegment(word); err != nil {
+			return nil, err
+		}
+
+		switch patternWords[i] {
+		case "*":
+			params = append(params, word)
+		case word:
+		default:
+			return nil, fmt.Errorf("%w: %q against %q", ErrKeyMismatch, key, pattern)
+		}
+	}
+
+	return params, nil
+}
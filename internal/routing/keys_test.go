@@ -0,0 +1,169 @@
+package routing
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestValidateSegment(t *testing.T) {
+	tests := []struct {
+		segment string
+		valid   bool
+	}{
+		{"washington", true},
+		{"george_washington-1", true},
+		{"jörg", true},
+		{"渡辺", true},
+		{"", false},
+		{"george.washington", false},
+		{"washington*", false},
+		{"#", false},
+		{"george washington", false},
+		{"george\u00a0washington", false},
+		{"washington\n", false},
+		{"wash\x00ington", false},
+	}
+
+	for _, tt := range tests {
+		err := ValidateSegment(tt.segment)
+		if tt.valid && err != nil {
+			t.Errorf("ValidateSegment(%q) = %v, want nil", tt.segment, err)
+		}
+		if !tt.valid && !errors.Is(err, ErrInvalidSegment) {
+			t.Errorf("ValidateSegment(%q) = %v, want ErrInvalidSegment", tt.segment, err)
+		}
+	}
+}
+
+func TestValidateUsername(t *testing.T) {
+	tests := []struct {
+		username string
+		valid    bool
+	}{
+		{"washington", true},
+		{strings.Repeat("a", MaxUsernameLength), true},
+		{strings.Repeat("a", MaxUsernameLength+1), false},
+		// The limit is in bytes, so fewer runes fit when they aren't ASCII.
+		{strings.Repeat("é", MaxUsernameLength/2), true},
+		{strings.Repeat("é", MaxUsernameLength/2+1), false},
+		{"", false},
+		{"lincoln.*", false},
+	}
+
+	for _, tt := range tests {
+		err := ValidateUsername(tt.username)
+		if tt.valid && err != nil {
+			t.Errorf("ValidateUsername(%q) = %v, want nil", tt.username, err)
+		}
+		if !tt.valid && !errors.Is(err, ErrInvalidSegment) {
+			t.Errorf("ValidateUsername(%q) = %v, want ErrInvalidSegment", tt.username, err)
+		}
+	}
+}
+
+func TestBuildKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		segments []string
+		want     string
+		wantErr  bool
+	}{
+		{name: "one segment", segments: []string{"pause"}, want: "pause"},
+		{name: "several segments", segments: []string{"army_moves", "washington"}, want: "army_moves.washington"},
+		{name: "non-ASCII", segments: []string{"army_moves", "jörg"}, want: "army_moves.jörg"},
+		{name: "no segments", wantErr: true},
+		{name: "empty segment", segments: []string{"army_moves", ""}, wantErr: true},
+		{name: "dot", segments: []string{"army_moves", "george.washington"}, wantErr: true},
+		{name: "star", segments: []string{"army_moves", "*"}, wantErr: true},
+		{name: "hash", segments: []string{"army_moves", "#"}, wantErr: true},
+		{name: "longest", segments: []string{strings.Repeat("a", 127), strings.Repeat("b", 127)}, want: strings.Repeat("a", 127) + "." + strings.Repeat("b", 127)},
+		{name: "too long", segments: []string{strings.Repeat("a", 128), strings.Repeat("b", 127)}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := BuildKey(tt.segments...)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("got key %q, want an error", key)
+				}
+				return
+			}
+			if err != nil || key != tt.want {
+				t.Fatalf("got %q, %v, want %q", key, err, tt.want)
+			}
+
+			// Whatever BuildKey makes, ParseKey takes apart again.
+			pattern := strings.Repeat("*.", len(tt.segments)-1) + "*"
+			params, err := ParseKey(pattern, key)
+			if err != nil || !slices.Equal(params, tt.segments) {
+				t.Errorf("ParseKey(%q, %q) = %q, %v, want %q", pattern, key, params, err, tt.segments)
+			}
+		})
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	tests := []struct {
+		pattern string
+		key     string
+		want    []string
+		wantErr error
+	}{
+		{pattern: "army_moves.*", key: "army_moves.washington", want: []string{"washington"}},
+		{pattern: "*.*", key: "game_logs.jörg", want: []string{"game_logs", "jörg"}},
+		{pattern: "pause", key: "pause"},
+		{pattern: "army_moves.*", key: "war.washington", wantErr: ErrKeyMismatch},
+		{pattern: "army_moves.*", key: "army_moves", wantErr: ErrKeyMismatch},
+		{pattern: "army_moves.*", key: "army_moves.george.washington", wantErr: ErrKeyMismatch},
+		{pattern: "army_moves.*", key: "army_moves.", wantErr: ErrInvalidSegment},
+		{pattern: "army_moves.*", key: "army_moves.*", wantErr: ErrInvalidSegment},
+		{pattern: "army_moves.*", key: "army_moves.#", wantErr: ErrInvalidSegment},
+		{pattern: "army_moves.*", key: "army_moves.george washington", wantErr: ErrInvalidSegment},
+	}
+
+	for _, tt := range tests {
+		params, err := ParseKey(tt.pattern, tt.key)
+		if tt.wantErr != nil {
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("ParseKey(%q, %q) = %q, %v, want %v", tt.pattern, tt.key, params, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || !slices.Equal(params, tt.want) {
+			t.Errorf("ParseKey(%q, %q) = %q, %v, want %q", tt.pattern, tt.key, params, err, tt.want)
+		}
+	}
+}
+
+func TestMatchKey(t *testing.T) {
+	tests := []struct {
+		pattern string
+		key     string
+		want    bool
+	}{
+		{"army_moves.*", "army_moves.washington", true},
+		{"army_moves.*", "army_moves", false},
+		{"army_moves.*", "army_moves.george.washington", false},
+		{"army_moves.*", "war.washington", false},
+		{"game_logs.#", "game_logs", true},
+		{"game_logs.#", "game_logs.washington", true},
+		{"game_logs.#", "game_logs.washington.1", true},
+		{"#", "anything.at.all", true},
+		{"#.washington", "army_moves.washington", true},
+		{"#.washington", "washington.army_moves", false},
+		{"*.#.*", "a", false},
+		{"*.#.*", "a.b", true},
+		{"pause", "pause", true},
+		{"pause", "pause.now", false},
+		{"war.jörg", "war.jörg", true},
+	}
+
+	for _, tt := range tests {
+		if got := MatchKey(tt.pattern, tt.key); got != tt.want {
+			t.Errorf("MatchKey(%q, %q) = %v, want %v", tt.pattern, tt.key, got, tt.want)
+		}
+	}
+}
@@ -11,3 +11,21 @@ type GameLog struct {
 	Message     string
 	Username    string
 }
+
+// ModerationEvent reports a player the server is throttling, and how many of their messages it has
+// dropped since the last report.
+type ModerationEvent struct {
+	Username string
+	Reason   string
+	Dropped  int
+	Time     time.Time
+}
+
+type PlayerPresence struct {
+	Username string
+}
+
+type Lobby struct {
+	PlayingState PlayingState
+	Players      []string
+}
@@ -8,10 +8,21 @@ const (
 	PauseKey = "pause"
 
 	GameLogSlug = "game_logs"
+
+	ModerationPrefix = "moderation"
+)
+
+const (
+	RPCJoinKey       = "rpc.join"
+	RPCLeaveKey      = "rpc.leave"
+	RPCPlayersKey    = "rpc.players"
+	RPCPauseStateKey = "rpc.pause_state"
 )
 
 const (
 	ExchangePerilDirect = "peril_direct"
 	ExchangePerilTopic  = "peril_topic"
 	ExchangePerilDLX    = "peril_dlx"
+	// ExchangePerilLogShards splits game logs between server instances by username.
+	ExchangePerilLogShards = "peril_log_shards"
 )
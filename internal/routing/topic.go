@@ -0,0 +1,116 @@
+package routing
+
+import (
+	"fmt"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/codec"
+	"strings"
+)
+
+// Topic ties a route to the type published on it and how it is encoded, so publishers and
+// subscribers can't disagree about either. pubsub.Bind gives it Publish and Subscribe methods.
+type Topic[T any] struct {
+	Exchange string
+	// Pattern is the binding key subscribers use. Each `*` word is a parameter that Key fills in,
+	// in order, to get the routing key to publish with.
+	Pattern string
+	// Queue is the name of the queue subscribers consume from, with parameters filled in the same way
+	// by QueueName.
+	Queue   string
+	Codec   codec.Codec
+	Durable bool
+}
+
+// Key is the routing key for the given parameters, which must pass ValidateSegment.
+func (t Topic[T]) Key(params ...string) (string, error) {
+	return fill(t.Pattern, params)
+}
+
+// QueueName is the subscriber queue for the given parameters.
+func (t Topic[T]) QueueName(params ...string) (string, error) {
+	return fill(t.Queue, params)
+}
+
+// Params parses a routing key of this topic back into the parameters it was built from, such as the
+// username in army_moves.<username>.
+func (t Topic[T]) Params(key string) ([]string, error) {
+	return ParseKey(t.Pattern, key)
+}
+
+// Matches reports whether key is one this topic's subscribers receive.
+func (t Topic[T]) Matches(key string) bool {
+	return MatchKey(t.Pattern, key)
+}
+
+func fill(template string, params []string) (string, error) {
+	words := strings.Split(template, ".")
+	next := 0
+	for i, word := range words {
+		if word != "*" {
+			continue
+		}
+		if next == len(params) {
+			return "", fmt.Errorf("%q needs more than %d parameters", template, len(params))
+		}
+		words[i] = params[next]
+		next++
+	}
+	if next != len(params) {
+		return "", fmt.Errorf("%q takes %d parameters, got %d", template, next, len(params))
+	}
+
+	return BuildKey(words...)
+}
+
+// MatchKey reports whether key matches a topic binding pattern, where `*` matches exactly one word
+// and `#` matches zero or more words.
+func MatchKey(pattern, key string) bool {
+	return matchWords(strings.Split(pattern, "."), strings.Split(key, "."))
+}
+
+func matchWords(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if matchWords(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && matchWords(pattern[1:], words[1:])
+	default:
+		return len(words) > 0 && pattern[0] == words[0] && matchWords(pattern[1:], words[1:])
+	}
+}
+
+var (
+	// GameLogs carries each player's game log lines to the server, which writes them to disk.
+	GameLogs = Topic[GameLog]{
+		Exchange: ExchangePerilTopic,
+		Pattern:  GameLogSlug + ".*",
+		Queue:    GameLogSlug,
+		Codec:    codec.MsgPack,
+		Durable:  true,
+	}
+
+	// Moderation carries the server's reports of misbehaving players to a queue for review.
+	Moderation = Topic[ModerationEvent]{
+		Exchange: ExchangePerilTopic,
+		Pattern:  ModerationPrefix + ".*",
+		Queue:    ModerationPrefix,
+		Codec:    codec.JSON,
+		Durable:  true,
+	}
+
+	// Pause carries the server's pause and resume commands to every player's own queue.
+	Pause = Topic[PlayingState]{
+		Exchange: ExchangePerilDirect,
+		Pattern:  PauseKey,
+		Queue:    PauseKey + ".*",
+		Codec:    codec.JSON,
+	}
+)
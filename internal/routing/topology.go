@@ -0,0 +1,220 @@
+package routing
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const QueuePerilDLQ = "peril_dlq"
+
+// QueuePerilLeader is the lock queue servers hold their leader election on.
+const QueuePerilLeader = "peril_leader"
+
+// ExchangeKindConsistentHash is the exchange type of the rabbitmq_consistent_hash_exchange plugin.
+// It sends each message to one binding, picked by hashing the routing key, and reads binding keys
+// as weights.
+const ExchangeKindConsistentHash = "x-consistent-hash"
+
+// LogShardWeight is the binding key each server instance binds its shard queue with, so every
+// instance gets an equal share of players.
+const LogShardWeight = "1"
+
+type ExchangeSpec struct {
+	Name       string
+	Kind       string
+	Durable    bool
+	AutoDelete bool
+	Internal   bool
+	Arguments  map[string]any
+}
+
+type QueueSpec struct {
+	Name       string
+	Durable    bool
+	AutoDelete bool
+	Exclusive  bool
+	// Type is the x-queue-type, such as "classic" or "quorum"; empty leaves it to the server.
+	Type string
+	// DeadLetterExchange receives messages that are rejected or expire; empty means none.
+	DeadLetterExchange   string
+	DeadLetterRoutingKey string
+	MessageTTL           time.Duration
+	Arguments            map[string]any
+}
+
+type BindingSpec struct {
+	Exchange  string
+	Queue     string
+	Key       string
+	Arguments map[string]any
+}
+
+// ExchangeBindingSpec routes messages from one exchange on to another.
+type ExchangeBindingSpec struct {
+	Source      string
+	Destination string
+	Key         string
+	Arguments   map[string]any
+}
+
+// Topology is the set of exchanges, queues and bindings a broker must have for the game to work.
+type Topology struct {
+	Exchanges        []ExchangeSpec
+	Queues           []QueueSpec
+	Bindings         []BindingSpec
+	ExchangeBindings []ExchangeBindingSpec
+}
+
+// PerilTopology is the shared part of the game's layout. Per-player queues are transient and are
+// declared by each client as it starts.
+var PerilTopology = Topology{
+	Exchanges: []ExchangeSpec{
+		{Name: ExchangePerilDirect, Kind: "direct", Durable: true},
+		{Name: ExchangePerilTopic, Kind: "topic", Durable: true},
+		{Name: ExchangePerilDLX, Kind: "fanout", Durable: true},
+	},
+	Queues: []QueueSpec{
+		{Name: QueuePerilDLQ, Durable: true},
+		{Name: GameLogSlug, Durable: true, DeadLetterExchange: ExchangePerilDLX},
+		{Name: WarRecognitionsPrefix, Durable: true, DeadLetterExchange: ExchangePerilDLX},
+		{Name: ModerationPrefix, Durable: true, DeadLetterExchange: ExchangePerilDLX},
+	},
+	Bindings: []BindingSpec{
+		{Exchange: ExchangePerilDLX, Queue: QueuePerilDLQ},
+		GameLogsBinding,
+		{Exchange: ExchangePerilTopic, Queue: WarRecognitionsPrefix, Key: WarRecognitionsPrefix + ".*"},
+		{Exchange: ExchangePerilTopic, Queue: ModerationPrefix, Key: ModerationPrefix + ".*"},
+	},
+}
+
+// ClientTopology is the part of PerilTopology clients depend on. The game log and moderation queues
+// belong to the server, which binds them for the mode it runs in, so clients leave them alone.
+var ClientTopology = Topology{
+	Exchanges: PerilTopology.Exchanges,
+	Queues: []QueueSpec{
+		{Name: QueuePerilDLQ, Durable: true},
+		{Name: WarRecognitionsPrefix, Durable: true, DeadLetterExchange: ExchangePerilDLX},
+	},
+	Bindings: []BindingSpec{
+		{Exchange: ExchangePerilDLX, Queue: QueuePerilDLQ},
+		{Exchange: ExchangePerilTopic, Queue: WarRecognitionsPrefix, Key: WarRecognitionsPrefix + ".*"},
+	},
+}
+
+// GameLogsBinding feeds the shared game_logs queue that unsharded servers compete for.
+var GameLogsBinding = BindingSpec{Exchange: ExchangePerilTopic, Queue: GameLogSlug, Key: GameLogSlug + ".*"}
+
+// ShardedPerilTopology is PerilTopology for servers that split game logs between them. Logs go
+// through a consistent-hash exchange, so each player's logs reach exactly one server's shard queue,
+// instead of to the shared game_logs queue. The game_logs queue is still declared so whatever was
+// left in it can be seen, but servers in this mode unbind it; run every server in the same mode.
+var ShardedPerilTopology = Topology{
+	Exchanges: append(append([]ExchangeSpec(nil), PerilTopology.Exchanges...),
+		ExchangeSpec{Name: ExchangePerilLogShards, Kind: ExchangeKindConsistentHash, Durable: true},
+	),
+	Queues:   PerilTopology.Queues,
+	Bindings: withoutBinding(PerilTopology.Bindings, GameLogsBinding),
+	ExchangeBindings: []ExchangeBindingSpec{
+		{Source: ExchangePerilTopic, Destination: ExchangePerilLogShards, Key: GameLogSlug + ".*"},
+	},
+}
+
+// GameLogShardQueue is the durable queue the server instance with the given shard name reads game
+// logs from. The name must pass ValidateSegment.
+func GameLogShardQueue(shard string) string {
+	return GameLogSlug + ".shard." + shard
+}
+
+func withoutBinding(bindings []BindingSpec, remove BindingSpec) []BindingSpec {
+	var kept []BindingSpec
+	for _, binding := range bindings {
+		if binding.Exchange != remove.Exchange || binding.Queue != remove.Queue || binding.Key != remove.Key {
+			kept = append(kept, binding)
+		}
+	}
+
+	return kept
+}
+
+// Args merges the queue's typed settings into its declaration arguments.
+func (q QueueSpec) Args() map[string]any {
+	args := map[string]any{}
+	for k, v := range q.Arguments {
+		args[k] = v
+	}
+
+	if q.Type != "" {
+		args["x-queue-type"] = q.Type
+	}
+	if q.DeadLetterExchange != "" {
+		args["x-dead-letter-exchange"] = q.DeadLetterExchange
+	}
+	if q.DeadLetterRoutingKey != "" {
+		args["x-dead-letter-routing-key"] = q.DeadLetterRoutingKey
+	}
+	if q.MessageTTL > 0 {
+		args["x-message-ttl"] = q.MessageTTL.Milliseconds()
+	}
+
+	if len(args) == 0 {
+		return nil
+	}
+	return args
+}
+
+// Validate checks that the topology is self-consistent: names are unique and every binding and
+// dead-letter exchange refers to something the topology declares, or to a built-in amq.* exchange.
+func (t Topology) Validate() error {
+	var errs []error
+
+	exchanges := map[string]bool{}
+	for _, exchange := range t.Exchanges {
+		if exchange.Name == "" {
+			errs = append(errs, errors.New("exchange without a name"))
+		}
+		if exchanges[exchange.Name] {
+			errs = append(errs, fmt.Errorf("exchange %s declared twice", exchange.Name))
+		}
+		exchanges[exchange.Name] = true
+	}
+
+	queues := map[string]bool{}
+	for _, queue := range t.Queues {
+		if queue.Name == "" {
+			errs = append(errs, errors.New("queue without a name"))
+		}
+		if queues[queue.Name] {
+			errs = append(errs, fmt.Errorf("queue %s declared twice", queue.Name))
+		}
+		queues[queue.Name] = true
+
+		if dlx := queue.DeadLetterExchange; dlx != "" && !exchanges[dlx] && !builtinExchange(dlx) {
+			errs = append(errs, fmt.Errorf("queue %s dead-letters to undeclared exchange %s", queue.Name, dlx))
+		}
+	}
+
+	for _, binding := range t.Bindings {
+		if !exchanges[binding.Exchange] && !builtinExchange(binding.Exchange) {
+			errs = append(errs, fmt.Errorf("binding %s -> %s uses undeclared exchange", binding.Exchange, binding.Queue))
+		}
+		if !queues[binding.Queue] {
+			errs = append(errs, fmt.Errorf("binding %s -> %s uses undeclared queue", binding.Exchange, binding.Queue))
+		}
+	}
+
+	for _, binding := range t.ExchangeBindings {
+		for _, name := range []string{binding.Source, binding.Destination} {
+			if !exchanges[name] && !builtinExchange(name) {
+				errs = append(errs, fmt.Errorf("binding %s -> exchange %s uses undeclared exchange %s", binding.Source, binding.Destination, name))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func builtinExchange(name string) bool {
+	return strings.HasPrefix(name, "amq.")
+}
@@ -0,0 +1,92 @@
+package tracing
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// JSONExporter writes each span as one line of JSON. Lines are written whole, so several processes
+// can append to the same file and the spans of a trace that crosses them end up side by side.
+type JSONExporter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer
+}
+
+type spanRecord struct {
+	TraceID    string            `json:"trace_id"`
+	SpanID     string            `json:"span_id"`
+	ParentID   string            `json:"parent_id,omitempty"`
+	Name       string            `json:"name"`
+	Start      time.Time         `json:"start"`
+	End        time.Time         `json:"end"`
+	DurationMS float64           `json:"duration_ms"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+func NewJSONExporter(w io.Writer) *JSONExporter {
+	return &JSONExporter{w: w}
+}
+
+// NewFileExporter appends spans to the file at path, creating it if needed.
+func NewFileExporter(path string) (*JSONExporter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &JSONExporter{w: file, closer: file}, nil
+}
+
+// Open returns an exporter writing to stdout when dest is "stdout", and to the file at dest
+// otherwise.
+func Open(dest string) (*JSONExporter, error) {
+	if dest == "stdout" {
+		return NewJSONExporter(os.Stdout), nil
+	}
+
+	return NewFileExporter(dest)
+}
+
+func (e *JSONExporter) Export(span *Span) {
+	record := spanRecord{
+		TraceID:    span.Context.TraceID.String(),
+		SpanID:     span.Context.SpanID.String(),
+		Name:       span.Name,
+		Start:      span.StartTime,
+		End:        span.EndTime,
+		DurationMS: float64(span.EndTime.Sub(span.StartTime).Microseconds()) / 1000,
+		Attributes: span.Attributes(),
+		Error:      span.Error,
+	}
+	if span.Parent != (SpanID{}) {
+		record.ParentID = span.Parent.String()
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		slog.Error("Could not encode span", "span", span.Name, "error", err)
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if _, err := e.w.Write(append(line, '\n')); err != nil {
+		slog.Error("Could not export span", "span", span.Name, "error", err)
+	}
+}
+
+// Close closes the file a file exporter writes to.
+func (e *JSONExporter) Close() error {
+	if e.closer == nil {
+		return nil
+	}
+
+	return e.closer.Close()
+}
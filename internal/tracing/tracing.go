@@ -0,0 +1,204 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TraceparentHeader is the W3C Trace Context header, carried as an AMQP message header.
+const TraceparentHeader = "traceparent"
+
+var ErrInvalidTraceparent = errors.New("invalid traceparent")
+
+type TraceID [16]byte
+
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+type SpanID [8]byte
+
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// SpanContext identifies a span across process boundaries.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// Traceparent formats the span context as a version 00 traceparent header value.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+
+	return fmt.Sprintf("00-%s-%s-%s", sc.TraceID, sc.SpanID, flags)
+}
+
+// ParseTraceparent reads a traceparent header value. Versions after 00 are accepted as long as they
+// start with the fields version 00 defines, as the spec asks.
+func ParseTraceparent(s string) (SpanContext, error) {
+	parts := strings.Split(s, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return SpanContext{}, fmt.Errorf("%w: %q", ErrInvalidTraceparent, s)
+	}
+
+	var sc SpanContext
+	var flags [1]byte
+	for _, field := range []struct {
+		hex string
+		dst []byte
+	}{
+		{parts[1], sc.TraceID[:]},
+		{parts[2], sc.SpanID[:]},
+		{parts[3], flags[:]},
+	} {
+		if len(field.hex) != 2*len(field.dst) || strings.ToLower(field.hex) != field.hex {
+			return SpanContext{}, fmt.Errorf("%w: %q", ErrInvalidTraceparent, s)
+		}
+		if _, err := hex.Decode(field.dst, []byte(field.hex)); err != nil {
+			return SpanContext{}, fmt.Errorf("%w: %q", ErrInvalidTraceparent, s)
+		}
+	}
+	sc.Sampled = flags[0]&1 == 1
+
+	if !sc.IsValid() {
+		return SpanContext{}, fmt.Errorf("%w: %q", ErrInvalidTraceparent, s)
+	}
+
+	return sc, nil
+}
+
+type contextKey struct{}
+
+// ContextWithSpanContext makes sc the parent of spans started from the returned context. Spans do
+// this for themselves; it is for span contexts that arrive from another process.
+func ContextWithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, contextKey{}, sc)
+}
+
+// FromContext returns the span context of the span ctx is in, if any.
+func FromContext(ctx context.Context) (SpanContext, bool) {
+	sc, ok := ctx.Value(contextKey{}).(SpanContext)
+	return sc, ok && sc.IsValid()
+}
+
+// Span is one timed operation in a trace.
+type Span struct {
+	Name    string
+	Context SpanContext
+	// Parent is the zero SpanID for the first span of a trace.
+	Parent    SpanID
+	StartTime time.Time
+	EndTime   time.Time
+	Error     string
+
+	mu         sync.Mutex
+	attributes map[string]string
+	ended      bool
+}
+
+// Start begins a span as a child of the one ctx is in, or as the first span of a new trace. The
+// returned context carries the new span.
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	span := &Span{Name: name, StartTime: time.Now(), attributes: map[string]string{}}
+
+	if parent, ok := FromContext(ctx); ok {
+		span.Context.TraceID = parent.TraceID
+		span.Context.Sampled = parent.Sampled
+		span.Parent = parent.SpanID
+	} else {
+		randomID(span.Context.TraceID[:])
+		span.Context.Sampled = true
+	}
+	randomID(span.Context.SpanID[:])
+
+	return ContextWithSpanContext(ctx, span.Context), span
+}
+
+func randomID(id []byte) {
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+}
+
+func (s *Span) SetAttribute(key, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.attributes[key] = value
+}
+
+// Attributes returns a copy of the span's attributes.
+func (s *Span) Attributes() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	attributes := make(map[string]string, len(s.attributes))
+	for k, v := range s.attributes {
+		attributes[k] = v
+	}
+
+	return attributes
+}
+
+// SetError marks the span as failed. A nil error leaves it alone.
+func (s *Span) SetError(err error) {
+	if err == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Error = err.Error()
+}
+
+// End records the span's end time and hands it to the exporter. Only the first call counts.
+func (s *Span) End() {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.EndTime = time.Now()
+	s.mu.Unlock()
+
+	if exporter := current.Load(); exporter != nil && s.Context.Sampled {
+		(*exporter).Export(s)
+	}
+}
+
+// Exporter receives every sampled span once it ends.
+type Exporter interface {
+	Export(span *Span)
+}
+
+var current atomic.Pointer[Exporter]
+
+// SetExporter sends ended spans to exporter. Until it is called, or after it is called with nil,
+// trace context still propagates but spans are dropped.
+func SetExporter(exporter Exporter) {
+	if exporter == nil {
+		current.Store(nil)
+		return
+	}
+
+	current.Store(&exporter)
+}
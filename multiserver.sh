@@ -19,12 +19,14 @@ show_help() {
   echo "  -c, --command COMMAND   Specify a custom command to run (default: go run ./cmd/server)"
   echo "  -t, --timeout SECONDS   Automatically stop servers after specified seconds"
   echo "  -s, --status            Check status of running servers"
+  echo "  -S, --sharded           Give each instance its own shard of the game logs (-shard 1, 2, ...)"
   echo
   echo "Examples:"
   echo "  $0 3                    Start 3 server instances"
   echo "  $0 -v 5                 Start 5 server instances with verbose output"
   echo "  $0 -c \"go run ./cmd/custom\" 2   Start 2 instances with a custom command"
   echo "  $0 -t 60 3              Start 3 instances and stop them after 60 seconds"
+  echo "  $0 -S 3                 Start 3 instances that split the game logs between them"
 }
 
 # Default values
@@ -32,6 +34,7 @@ verbose=false
 command="go run ./cmd/server"
 timeout=0
 check_status=false
+sharded=false
 pid_file="/tmp/multiserver_pids.txt"
 
 # Parse command line options
@@ -69,6 +72,10 @@ while [[ $# -gt 0 ]]; do
       check_status=true
       shift
       ;;
+    -S|--sharded)
+      sharded=true
+      shift
+      ;;
     *)
       # If it's not an option, assume it's the number of instances
       if [[ $1 =~ ^[0-9]+$ ]]; then
@@ -192,8 +199,13 @@ for (( i=0; i<num_instances; i++ )); do
     echo "Starting server instance #$((i+1))..."
   fi
 
+  instance_command="$command"
+  if [ "$sharded" = true ]; then
+    instance_command="$command -shard $((i+1))"
+  fi
+
   # Use eval to properly handle quoted arguments in the command
-  eval "$command" &
+  eval "$instance_command" &
   current_pid=$!
   pids+=($current_pid)
 